@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AccessLogEntry is one request in the access log, and what custom templates
+// can use, eg {{.RemoteAddr}} {{.Method}} {{.Path}} {{.Status}} {{ms .Latency}}
+type AccessLogEntry struct {
+	Time            time.Time
+	RequestID       string
+	RemoteAddr      string
+	Method          string
+	Path            string
+	RequestURI      string
+	Proto           string
+	Status          int
+	Bytes           int64
+	Sub             string
+	Upstream        string
+	Referer         string
+	UserAgent       string
+	Error           string
+	AuthLatency     time.Duration
+	UpstreamLatency time.Duration
+	Latency         time.Duration
+}
+
+// Access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogTemplate = "template"
+)
+
+// clfTime is the timestamp layout of the Common Log Format
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+var accessLogFuncs = template.FuncMap{
+	"ms": milliseconds,
+	"clfTime": func(t time.Time) string {
+		return t.Format(clfTime)
+	},
+}
+
+// accessLogger writes access log entries to their own sink, apart from the diagnostics
+type accessLogger struct {
+	format   string
+	template *template.Template
+
+	mu   sync.Mutex
+	sink Sink
+}
+
+var accessLog = &accessLogger{format: AccessLogJSON, sink: writerSink{os.Stdout}}
+
+// newAccessLogger returns a logger in format, text is the template for the template format
+func newAccessLogger(sink Sink, format string, text string) (*accessLogger, error) {
+	l := &accessLogger{format: format, sink: sink}
+
+	switch format {
+	case AccessLogJSON, AccessLogCommon, AccessLogCombined:
+	case AccessLogTemplate:
+		if text == "" {
+			return nil, fmt.Errorf("the template access log format needs a template")
+		}
+
+		tmpl, err := template.New("access").Funcs(accessLogFuncs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		l.template = tmpl
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+
+	return l, nil
+}
+
+func (l *accessLogger) write(entry AccessLogEntry) error {
+	var line bytes.Buffer
+	switch l.format {
+	case AccessLogCommon:
+		writeCommonLog(&line, entry)
+	case AccessLogCombined:
+		writeCommonLog(&line, entry)
+		line.WriteString(` "` + clfEscape(entry.Referer) + `" "` + clfEscape(entry.UserAgent) + `"`)
+	case AccessLogTemplate:
+		if err := l.template.Execute(&line, entry); err != nil {
+			return err
+		}
+	default:
+		if err := writeJSONAccessLog(&line, entry); err != nil {
+			return err
+		}
+	}
+
+	if line.Len() == 0 || line.Bytes()[line.Len()-1] != '\n' {
+		line.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sink.Write(LevelInfo, line.Bytes())
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeCommonLog writes entry as `host ident user [time] "request" status bytes`
+func writeCommonLog(b *bytes.Buffer, entry AccessLogEntry) {
+	bytesSent := "-"
+	if entry.Bytes > 0 {
+		bytesSent = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	fmt.Fprintf(b, `%s - %s [%s] "%s %s %s" %d %s`,
+		clfField(entry.RemoteAddr),
+		clfField(entry.Sub),
+		entry.Time.Format(clfTime),
+		clfEscape(entry.Method),
+		clfEscape(entry.RequestURI),
+		clfEscape(entry.Proto),
+		entry.Status,
+		bytesSent,
+	)
+}
+
+// clfField is s escaped, or "-" when it's empty
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return clfEscape(s)
+}
+
+// clfEscape escapes quotes, backslashes and unprintable bytes the way Apache does
+func clfEscape(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func writeJSONAccessLog(b *bytes.Buffer, entry AccessLogEntry) error {
+	record := struct {
+		Time       string  `json:"time"`
+		RequestID  string  `json:"requestId"`
+		RemoteAddr string  `json:"remoteAddr"`
+		Method     string  `json:"method"`
+		Path       string  `json:"path"`
+		Proto      string  `json:"proto"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		Sub        string  `json:"sub"`
+		Upstream   string  `json:"upstream"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"userAgent"`
+		Error      string  `json:"error,omitempty"`
+		AuthMs     float64 `json:"authMs"`
+		UpstreamMs float64 `json:"upstreamMs"`
+		TotalMs    float64 `json:"totalMs"`
+	}{
+		Time:       entry.Time.UTC().Format(time.RFC3339Nano),
+		RequestID:  entry.RequestID,
+		RemoteAddr: entry.RemoteAddr,
+		Method:     entry.Method,
+		Path:       entry.Path,
+		Proto:      entry.Proto,
+		Status:     entry.Status,
+		Bytes:      entry.Bytes,
+		Sub:        entry.Sub,
+		Upstream:   entry.Upstream,
+		Referer:    entry.Referer,
+		UserAgent:  entry.UserAgent,
+		Error:      entry.Error,
+		AuthMs:     milliseconds(entry.AuthLatency),
+		UpstreamMs: milliseconds(entry.UpstreamLatency),
+		TotalMs:    milliseconds(entry.Latency),
+	}
+
+	return json.NewEncoder(b).Encode(record)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var testAccessEntry = AccessLogEntry{
+	Time:            time.Date(2019, 8, 5, 13, 4, 5, 0, time.FixedZone("", -7*60*60)),
+	RequestID:       "req-42",
+	RemoteAddr:      "192.0.2.1",
+	Method:          "GET",
+	Path:            "/users",
+	RequestURI:      "/users?name=%22ada%22",
+	Proto:           "HTTP/1.1",
+	Status:          200,
+	Bytes:           2326,
+	Sub:             "1234-abcd",
+	Upstream:        "default",
+	Referer:         "https://example.com/",
+	UserAgent:       `curl/7.64 "quoted"`,
+	AuthLatency:     2 * time.Millisecond,
+	UpstreamLatency: 10 * time.Millisecond,
+	Latency:         12500 * time.Microsecond,
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	empty := AccessLogEntry{Time: testAccessEntry.Time, Method: "GET", RequestURI: "/", Proto: "HTTP/1.1", Status: 401}
+
+	cases := []struct {
+		format   string
+		template string
+		entry    AccessLogEntry
+		out      string
+	}{
+		{AccessLogCommon, "", testAccessEntry, `192.0.2.1 - 1234-abcd [05/Aug/2019:13:04:05 -0700] "GET /users?name=%22ada%22 HTTP/1.1" 200 2326` + "\n"},
+		{AccessLogCommon, "", empty, `- - - [05/Aug/2019:13:04:05 -0700] "GET / HTTP/1.1" 401 -` + "\n"},
+		{AccessLogCombined, "", testAccessEntry, `192.0.2.1 - 1234-abcd [05/Aug/2019:13:04:05 -0700] "GET /users?name=%22ada%22 HTTP/1.1" 200 2326 "https://example.com/" "curl/7.64 \"quoted\""` + "\n"},
+		{AccessLogTemplate, `{{.RequestID}} {{.Method}} {{.Path}} {{.Status}} {{ms .Latency}}ms`, testAccessEntry, "req-42 GET /users 200 12.5ms\n"},
+		{AccessLogTemplate, `[{{clfTime .Time}}] {{.Upstream}}` + "\n", testAccessEntry, "[05/Aug/2019:13:04:05 -0700] default\n"},
+		{AccessLogJSON, "", testAccessEntry, `{"time":"2019-08-05T20:04:05Z","requestId":"req-42","remoteAddr":"192.0.2.1","method":"GET","path":"/users","proto":"HTTP/1.1","status":200,"bytes":2326,"sub":"1234-abcd","upstream":"default","referer":"https://example.com/","userAgent":"curl/7.64 \"quoted\"","authMs":2,"upstreamMs":10,"totalMs":12.5}` + "\n"},
+	}
+	for _, i := range cases {
+		var out bytes.Buffer
+		l, err := newAccessLogger(writerSink{&out}, i.format, i.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.write(i.entry); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != i.out {
+			t.Error(i.format + ": '" + out.String() + "' != '" + i.out + "'")
+		}
+	}
+}
+
+func TestClfEscape(t *testing.T) {
+	cases := [][]string{
+		{"plain", "plain"},
+		{`say "hi"`, `say \"hi\"`},
+		{`back\slash`, `back\\slash`},
+		{"line\nbreak", `line\x0abreak`},
+		{"é", `\xc3\xa9`},
+	}
+	for _, i := range cases {
+		if result := clfEscape(i[0]); result != i[1] {
+			t.Error("'" + result + "' != '" + i[1] + "'")
+		}
+	}
+}
+
+func TestAccessLoggerValidation(t *testing.T) {
+	cases := [][]string{
+		{"apache", ""},
+		{AccessLogTemplate, ""},
+		{AccessLogTemplate, "{{.Missing"},
+	}
+	for _, i := range cases {
+		if _, err := newAccessLogger(writerSink{&bytes.Buffer{}}, i[0], i[1]); err == nil {
+			t.Error("expected " + i[0] + " '" + i[1] + "' to be rejected")
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// requestIDHeader carries the request ID upstream and back to the client
+const requestIDHeader = "X-Request-Id"
+
+// accessRecord collects what the access log says about one request
+type accessRecord struct {
+	id         string
+	remoteAddr string
+	method     string
+	path       string
+	route      string
+	requestURI string
+	proto      string
+	referer    string
+	userAgent  string
+	start      time.Time
+	sub        string
+	upstream   string
+	err        string
+
+	authLatency     time.Duration
+	upstreamLatency time.Duration
+
+	// requestBody waits here for the response when bodies are logged for errors only
+	requestBody   interface{}
+	requestLogged bool
+}
+
+type accessRecordContextKey struct{}
+
+// newAccessRecord starts the record for req, keeping the client's request ID when it sent a usable one
+func newAccessRecord(req *http.Request) *accessRecord {
+	id := req.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+
+	remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteAddr = req.RemoteAddr
+	}
+
+	return &accessRecord{
+		id:         id,
+		remoteAddr: remoteAddr,
+		method:     req.Method,
+		path:       req.URL.Path,
+		proto:      req.Proto,
+		referer:    loggedReferer(req.Referer()),
+		userAgent:  req.UserAgent(),
+		start:      time.Now(),
+	}
+}
+
+// loggedRequestURI is the request URI the logs show for req. It's built from
+// req.URL rather than taken from req.RequestURI, so a token taken out of the
+// query string stays out of the logs, and the query is redacted.
+func loggedRequestURI(req *http.Request) string {
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	if req.URL.RawQuery != "" {
+		uri += "?" + redaction.query(req.URL.Query()).Encode()
+	}
+	return uri
+}
+
+// loggedReferer is referer with its query redacted like the request's own, as
+// the page a client came from can carry tokens too
+func loggedReferer(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return redactedValue
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redaction.query(u.Query()).Encode()
+	}
+	return u.String()
+}
+
+// validRequestID accepts IDs of up to 128 visible ASCII characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// context returns ctx carrying the record and a logger tagging records with its request ID
+func (r *accessRecord) context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, accessRecordContextKey{}, r)
+	return withLogger(ctx, loggerFrom(ctx).With("requestId", r.id))
+}
+
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	record, _ := ctx.Value(accessRecordContextKey{}).(*accessRecord)
+	return record
+}
+
+// log writes the access log entry and request metrics once the response in w is done
+func (r *accessRecord) log(ctx context.Context, w *accessLogResponseWriter) {
+	entry := AccessLogEntry{
+		Time:            r.start,
+		RequestID:       r.id,
+		RemoteAddr:      r.remoteAddr,
+		Method:          r.method,
+		Path:            r.path,
+		RequestURI:      r.requestURI,
+		Proto:           r.proto,
+		Status:          w.statusCode(),
+		Bytes:           w.bytes,
+		Sub:             r.sub,
+		Upstream:        r.upstream,
+		Referer:         r.referer,
+		UserAgent:       r.userAgent,
+		Error:           r.err,
+		AuthLatency:     r.authLatency,
+		UpstreamLatency: r.upstreamLatency,
+		Latency:         time.Since(r.start),
+	}
+
+	if err := accessLog.write(entry); err != nil {
+		loggerFrom(ctx).Error("unable to write access log", "error", err)
+	}
+
+	route := r.route
+	if route == "" {
+		route = "default"
+	}
+
+	labels := []string{route, metricMethod(r.method), strconv.Itoa(w.statusCode())}
+	requestsTotal.inc(labels...)
+	requestDuration.observe(entry.Latency.Seconds(), labels...)
+}
+
+// accessLogResponseWriter records the status and body size sent to the client
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// statusCode is the status sent, net/http answers 200 when nothing was written
+func (w *accessLogResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands over the connection for upgrades. Its bytes aren't counted from
+// then on, but it's tracked so a shutdown can wait for it.
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.status = http.StatusSwitchingProtocols
+	return hijacked.track(conn), rw, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	cases := []struct {
+		incoming string
+		kept     bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"trace:1/2+3", true},
+		{"has space", false},
+		{"line\nbreak", false},
+		{"é", false},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, i := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(requestIDHeader, i.incoming)
+		id := newAccessRecord(req).id
+
+		if i.kept && id != i.incoming {
+			t.Error("'" + id + "' != '" + i.incoming + "'")
+		}
+		if !i.kept && !uuid.MatchString(id) {
+			t.Error("expected a generated id for '" + i.incoming + "', got '" + id + "'")
+		}
+	}
+
+	if newRequestID() == newRequestID() {
+		t.Error("expected request ids to be unique")
+	}
+}
+
+func TestAccessLogRecord(t *testing.T) {
+	previous, previousAccess := logger, accessLog
+	l, out := testLogger(t, FormatJSON, LevelInfo)
+	var accessOut bytes.Buffer
+	logger, accessLog = l, &accessLogger{format: AccessLogJSON, sink: writerSink{&accessOut}}
+	defer func() { logger, accessLog = previous, previousAccess }()
+
+	req := httptest.NewRequest(http.MethodGet, "/users?page=2", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	res := httptest.NewRecorder()
+	handleRequest(res, req)
+
+	if res.Header().Get(requestIDHeader) != "req-42" {
+		t.Error("expected the request id on the response")
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["requestId"] != "req-42" {
+			t.Error("record without the request id: " + line)
+		}
+	}
+
+	if lines := strings.Count(accessOut.String(), "\n"); lines != 1 {
+		t.Fatalf("expected a single access record, got %d", lines)
+	}
+	var access map[string]interface{}
+	if err := json.Unmarshal(accessOut.Bytes(), &access); err != nil {
+		t.Fatal(err)
+	}
+	if access["requestId"] != "req-42" || access["method"] != "GET" || access["path"] != "/users" || access["status"] != float64(401) || access["error"] != "Unauthorized" {
+		t.Error("unexpected access record", access)
+	}
+	if access["bytes"].(float64) == 0 || access["totalMs"].(float64) <= 0 {
+		t.Error("expected the size and duration of the response", access)
+	}
+}
+
+func TestAccessLogUpstreamLatency(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set(requestIDHeader, "upstream-id")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	record := newAccessRecord(req)
+	req = req.WithContext(record.context(req.Context()))
+
+	writer := &accessLogResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, writer, req)
+
+	if record.upstreamLatency < 20*time.Millisecond {
+		t.Errorf("expected the upstream latency to be recorded, got %s", record.upstreamLatency)
+	}
+	if writer.status != http.StatusOK || writer.bytes != 2 {
+		t.Errorf("expected 200 and 2 bytes, got %d and %d", writer.status, writer.bytes)
+	}
+	if writer.Header().Get(requestIDHeader) != "" {
+		t.Error("expected the upstream's request id to be dropped")
+	}
+}
+
+func TestAccessLogImplicitStatus(t *testing.T) {
+	previous := accessLog
+	var accessOut bytes.Buffer
+	accessLog = &accessLogger{format: AccessLogJSON, sink: writerSink{&accessOut}}
+	defer func() { accessLog = previous }()
+
+	// A handler that writes nothing answers 200
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	newAccessRecord(req).log(req.Context(), &accessLogResponseWriter{ResponseWriter: httptest.NewRecorder()})
+
+	var access map[string]interface{}
+	if err := json.Unmarshal(accessOut.Bytes(), &access); err != nil {
+		t.Fatal(err)
+	}
+	if access["status"] != float64(http.StatusOK) {
+		t.Errorf("expected 200, got %v", access["status"])
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// adminToken is the bearer token the admin API wants, the API is off without one
+var adminToken string
+
+// effectiveSettings are the settings resolved from the environment at startup,
+// with the config file's defaults filled in. Secrets are left out or redacted.
+type effectiveSettings struct {
+	Port              string `json:"port"`
+	URL               string `json:"url"`
+	UpstreamProtocol  string `json:"upstreamProtocol"`
+	Region            string `json:"region"`
+	PoolID            string `json:"poolId"`
+	ClientID          string `json:"clientId"`
+	ConfigFile        string `json:"configFile"`
+	LogLevel          string `json:"logLevel"`
+	LogLevelFile      string `json:"logLevelFile"`
+	LogFormat         string `json:"logFormat"`
+	LogSink           string `json:"logSink"`
+	LogFileMaxSize    int64  `json:"logFileMaxSize"`
+	LogFileMaxBackups int    `json:"logFileMaxBackups"`
+	AccessLogSink     string `json:"accessLogSink"`
+	AccessLogFormat   string `json:"accessLogFormat"`
+	AccessLogTemplate string `json:"accessLogTemplate"`
+
+	TracesEndpoint   string            `json:"tracesEndpoint"`
+	TracesSampleRate float64           `json:"tracesSampleRate"`
+	TracesHeaders    map[string]string `json:"tracesHeaders"`
+	ServiceName      string            `json:"serviceName"`
+
+	KeyCollisionPolicy string `json:"keyCollisionPolicy"`
+	KeyRoundTrip       bool   `json:"keyRoundTrip"`
+	KeyCacheSize       int    `json:"keyCacheSize"`
+	MaxBufferedBody    int64  `json:"maxBufferedBody"`
+
+	MetricsPath string `json:"metricsPath"`
+	HealthPath  string `json:"healthPath"`
+	ReadyPath   string `json:"readyPath"`
+	VersionPath string `json:"versionPath"`
+	AdminPort   string `json:"adminPort"`
+	AdminToken  bool   `json:"adminToken"`
+
+	UserCacheTTL           string `json:"userCacheTTL"`
+	UserCacheSize          int    `json:"userCacheSize"`
+	UpstreamHealthInterval string `json:"upstreamHealthInterval"`
+	UpstreamHealthTimeout  string `json:"upstreamHealthTimeout"`
+	ShutdownDelay          string `json:"shutdownDelay"`
+	ShutdownGracePeriod    string `json:"shutdownGracePeriod"`
+
+	BodyLogging effectiveBodyLogging `json:"bodyLogging"`
+	TLSFiles    []string             `json:"tlsFiles"`
+}
+
+// effectiveBodyLogging is the compiled body logging policy
+type effectiveBodyLogging struct {
+	MaxBytes          int      `json:"maxBytes"`
+	SamplePercent     float64  `json:"samplePercent"`
+	ErrorsOnly        bool     `json:"errorsOnly"`
+	AllowRoutes       []string `json:"allowRoutes"`
+	DenyRoutes        []string `json:"denyRoutes"`
+	AllowContentTypes []string `json:"allowContentTypes"`
+	DenyContentTypes  []string `json:"denyContentTypes"`
+	SummarizeOther    bool     `json:"summarizeOther"`
+}
+
+// effective is filled in by init and shown by the admin API
+var effective effectiveSettings
+
+// withBodyLogging adds the body logging policy p to the settings
+func (s *effectiveSettings) withBodyLogging(p *bodyLogPolicy) {
+	s.BodyLogging = effectiveBodyLogging{
+		MaxBytes:          p.maxBytes,
+		SamplePercent:     p.samplePercent,
+		ErrorsOnly:        p.errorsOnly,
+		AllowRoutes:       p.allowRoutes,
+		DenyRoutes:        p.denyRoutes,
+		AllowContentTypes: p.allowTypes,
+		DenyContentTypes:  p.denyTypes,
+		SummarizeOther:    p.summarize,
+	}
+}
+
+// withTLSFiles adds the certificate, key and CA files of config's listener and upstreams
+func (s *effectiveSettings) withTLSFiles(config *ProxyConfig) {
+	s.TLSFiles = nil
+	add := func(files ...string) {
+		for _, file := range files {
+			if file != "" {
+				s.TLSFiles = append(s.TLSFiles, file)
+			}
+		}
+	}
+
+	if config.TLS != nil {
+		for _, certificate := range config.TLS.Certificates {
+			add(certificate.CertFile, certificate.KeyFile)
+		}
+		add(config.TLS.ClientCAFile)
+	}
+
+	names := make([]string, 0, len(config.Upstreams))
+	for name := range config.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if upstreamTLS := config.Upstreams[name].TLS; upstreamTLS != nil {
+			add(upstreamTLS.CAFile, upstreamTLS.CertFile, upstreamTLS.KeyFile)
+		}
+	}
+}
+
+// redactedURL hides the password in a URL's userinfo, like url.URL.Redacted in newer Go
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedValue
+	}
+	if u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// maintenanceRoutes are route prefixes taken out of service, with the message their callers get
+type maintenanceRoutes struct {
+	mu     sync.RWMutex
+	routes map[string]string
+}
+
+var maintenance = &maintenanceRoutes{routes: make(map[string]string)}
+
+// defaultMaintenanceMessage is what callers get when no message was given
+const defaultMaintenanceMessage = "Down for maintenance"
+
+func (m *maintenanceRoutes) message(prefix string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	message, ok := m.routes[prefix]
+	return message, ok
+}
+
+func (m *maintenanceRoutes) set(prefix, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes[prefix] = message
+}
+
+func (m *maintenanceRoutes) clear(prefix string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.routes[prefix]
+	delete(m.routes, prefix)
+	return ok
+}
+
+func (m *maintenanceRoutes) list() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	routes := make(map[string]string, len(m.routes))
+	for prefix, message := range m.routes {
+		routes[prefix] = message
+	}
+	return routes
+}
+
+// handleAdmin registers the admin API on mux, behind token
+func handleAdmin(mux *http.ServeMux, token string) {
+	api := http.NewServeMux()
+	api.HandleFunc("/admin/config", adminConfig)
+	api.HandleFunc("/admin/routes", adminRoutes)
+	api.HandleFunc("/admin/upstreams", adminUpstreams)
+	api.HandleFunc("/admin/users", adminUsers)
+	api.HandleFunc("/admin/users/", adminUser)
+	api.HandleFunc("/admin/jwks/refresh", adminRefreshJWKS)
+	api.HandleFunc("/admin/body-logging", adminBodyLogging)
+	api.HandleFunc("/admin/maintenance", adminMaintenance)
+
+	mux.Handle("/admin/", requireAdminToken(token, api))
+}
+
+// requireAdminToken lets through requests with token as their bearer token
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			logger.Warn("rejected admin request", "method", req.Method, "path", req.URL.Path, "address", req.RemoteAddr)
+			res.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			adminError(res, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		if req.Method != http.MethodGet {
+			logger.Info("admin request", "method", req.Method, "path", req.URL.Path, "address", req.RemoteAddr)
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+func adminJSON(res http.ResponseWriter, status int, data interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(map[string]interface{}{"data": data, "error": nil})
+}
+
+func adminError(res http.ResponseWriter, status int, message string) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(map[string]interface{}{"data": nil, "error": message})
+}
+
+// allowMethods answers 405 unless req uses one of methods
+func allowMethods(res http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+
+	res.Header().Set("Allow", strings.Join(methods, ", "))
+	adminError(res, http.StatusMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+// adminConfig shows the config file as loaded, the settings resolved from the
+// environment and the settings changed at runtime
+func adminConfig(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+
+	b, err := json.Marshal(proxyConfig)
+	if err != nil {
+		adminError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var config map[string]interface{}
+	json.Unmarshal(b, &config)
+	if redaction, ok := config["redaction"].(map[string]interface{}); ok && redaction["salt"] != "" {
+		redaction["salt"] = redactedValue
+	}
+
+	adminJSON(res, http.StatusOK, map[string]interface{}{
+		"config":    config,
+		"effective": effective,
+		"runtime": map[string]interface{}{
+			"version":      version,
+			"logLevel":     logger.Level().String(),
+			"bodyLogDebug": debuggingBodies(),
+			"userCacheTTL": userAttributes.ttl.String(),
+			"maintenance":  maintenance.list(),
+			"shuttingDown": isShuttingDown(),
+		},
+	})
+}
+
+// adminRoutes lists the routes in the order they're configured, then the default route
+func adminRoutes(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+
+	routes := append(append([]RouteConfig{}, proxyConfig.Routes...), RouteConfig{})
+
+	table := make([]map[string]interface{}, 0, len(routes))
+	for _, route := range routes {
+		upstream, auth := route.Upstream, route.Auth
+		if upstream == "" {
+			upstream = "default"
+		}
+		if auth == "" {
+			auth = AuthBearer
+		}
+
+		_, inMaintenance := maintenance.message(route.Prefix)
+		table = append(table, map[string]interface{}{
+			"prefix":       route.Prefix,
+			"upstream":     upstream,
+			"auth":         auth,
+			"convertQuery": route.ConvertQuery,
+			"convertForm":  route.ConvertForm,
+			"jsonHeaders":  route.JSONHeaders,
+			"maintenance":  inMaintenance,
+		})
+	}
+
+	adminJSON(res, http.StatusOK, table)
+}
+
+// adminUpstreams reports the last health check of every upstream
+func adminUpstreams(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+
+	upstreams := make(map[string]interface{}, len(proxyConfig.Upstreams))
+	for name, upstream := range proxyConfig.Upstreams {
+		checked, err := upstream.health.status()
+
+		status := map[string]interface{}{
+			"url":     upstream.URL,
+			"healthy": err == nil,
+		}
+		if !checked.IsZero() {
+			status["lastChecked"] = checked.UTC().Format(time.RFC3339)
+		}
+		if err != nil {
+			status["error"] = err.Error()
+		}
+		upstreams[name] = status
+	}
+
+	adminJSON(res, http.StatusOK, upstreams)
+}
+
+// adminUsers lists the cached users, or flushes the cache with DELETE
+func adminUsers(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		flushed := userAttributes.flush()
+		logger.Info("flushed user attribute cache", "users", flushed)
+		adminJSON(res, http.StatusOK, map[string]int{"flushed": flushed})
+		return
+	}
+
+	expiries := make(map[string]string)
+	for username, expires := range userAttributes.expiries() {
+		expiries[username] = expires.UTC().Format(time.RFC3339)
+	}
+
+	adminJSON(res, http.StatusOK, map[string]interface{}{
+		"enabled": userAttributes.enabled(),
+		"ttl":     userAttributes.ttl.String(),
+		"users":   expiries,
+	})
+}
+
+// adminUser shows the cached attributes of one user, or drops them with DELETE
+func adminUser(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	username := strings.TrimPrefix(req.URL.Path, "/admin/users/")
+
+	if req.Method == http.MethodDelete {
+		if !userAttributes.remove(username) {
+			adminError(res, http.StatusNotFound, "User not cached")
+			return
+		}
+		logger.Info("removed user from attribute cache", "username", username)
+		adminJSON(res, http.StatusOK, map[string]string{"removed": username})
+		return
+	}
+
+	attributes, ok := userAttributes.get(username)
+	if !ok {
+		adminError(res, http.StatusNotFound, "User not cached")
+		return
+	}
+	adminJSON(res, http.StatusOK, attributes)
+}
+
+// adminRefreshJWKS fetches the user pool's signing keys again
+func adminRefreshJWKS(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodPost) {
+		return
+	}
+
+	if authClient == nil {
+		adminError(res, http.StatusServiceUnavailable, "No Cognito client")
+		return
+	}
+
+	if err := authClient.getWellKnownJWTKs(); err != nil {
+		adminError(res, http.StatusBadGateway, "Unable to fetch signing keys: "+err.Error())
+		return
+	}
+
+	keys := authClient.keySet()
+	logger.Info("refreshed signing keys", "keys", len(keys.Keys))
+	adminJSON(res, http.StatusOK, map[string]int{"keys": len(keys.Keys)})
+}
+
+// adminBodyLogging shows or switches debug body logging, eg PUT {"debug": true}
+func adminBodyLogging(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if req.Method == http.MethodPut {
+		var body struct {
+			Debug *bool `json:"debug"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Debug == nil {
+			adminError(res, http.StatusBadRequest, `Body must be {"debug": true|false}`)
+			return
+		}
+
+		var debug int32
+		if *body.Debug {
+			debug = 1
+		}
+		atomic.StoreInt32(&bodyLogDebug, debug)
+		logger.Info("switched debug body logging", "debug", *body.Debug)
+	}
+
+	adminJSON(res, http.StatusOK, map[string]bool{"debug": debuggingBodies()})
+}
+
+// adminMaintenance lists the routes in maintenance. PUT {"prefix": "/orders", "message": "..."}
+// takes a route out of service, and DELETE ?prefix=/orders puts it back. The
+// empty prefix is the default route.
+func adminMaintenance(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var body struct {
+			Prefix  *string `json:"prefix"`
+			Message string  `json:"message"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Prefix == nil {
+			adminError(res, http.StatusBadRequest, `Body must be {"prefix": "/route", "message": "..."}`)
+			return
+		}
+		if !isRoutePrefix(*body.Prefix) {
+			adminError(res, http.StatusNotFound, "No route with prefix "+*body.Prefix)
+			return
+		}
+
+		message := body.Message
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+		maintenance.set(*body.Prefix, message)
+		logger.Warn("route in maintenance", "prefix", *body.Prefix)
+	case http.MethodDelete:
+		prefix := req.URL.Query().Get("prefix")
+		if !maintenance.clear(prefix) {
+			adminError(res, http.StatusNotFound, "Route isn't in maintenance")
+			return
+		}
+		logger.Info("route back in service", "prefix", prefix)
+	}
+
+	adminJSON(res, http.StatusOK, maintenance.list())
+}
+
+// isRoutePrefix reports whether prefix is a configured route, or the default route's empty prefix
+func isRoutePrefix(prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+
+	for _, route := range proxyConfig.Routes {
+		if route.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
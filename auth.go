@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Ways a route lets callers authenticate
+const (
+	AuthBearer = "bearer"
+	AuthMTLS   = "mtls"
+	AuthBoth   = "both"
+)
+
+// Certificate fields the username of a client certificate can be taken from
+var clientUsernameFields = map[string]bool{
+	"commonName": true,
+	"dnsName":    true,
+	"email":      true,
+	"uri":        true,
+}
+
+// Authentication failures that are reported on their own
+var (
+	errNoClientCertificate    = errors.New("no verified client certificate present in request")
+	errNoAuthorization        = errors.New("no authorization header present in request")
+	errMalformedAuthorization = errors.New("malformed authorization header present in request")
+	errUserDisabled           = errors.New("user is disabled")
+	errUserUnconfirmed        = errors.New("user is not confirmed")
+	errInvalidToken           = errors.New("invalid token")
+)
+
+func (r *RouteConfig) acceptsClientCertificates() bool {
+	return r.Auth == AuthMTLS || r.Auth == AuthBoth
+}
+
+func (r *RouteConfig) acceptsBearerTokens() bool {
+	return r.Auth == "" || r.Auth == AuthBearer || r.Auth == AuthBoth
+}
+
+// authenticateRequest identifies the caller with whichever methods route
+// accepts. A verified client certificate wins over a bearer token.
+func authenticateRequest(req *http.Request, route *RouteConfig) (User, error) {
+	if route.acceptsClientCertificates() {
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			return certificateUser(req.TLS.VerifiedChains[0][0], proxyConfig.TLS.ClientUsername)
+		}
+
+		if !route.acceptsBearerTokens() {
+			return User{authenticated: false}, errNoClientCertificate
+		}
+	}
+
+	return bearerUser(req)
+}
+
+func bearerUser(req *http.Request) (User, error) {
+	authorizationHeader := req.Header.Get("Authorization")
+	if authorizationHeader == "" {
+		return User{authenticated: false}, errNoAuthorization
+	}
+
+	bearerToken := strings.Split(authorizationHeader, " ")
+	if len(bearerToken) != 2 {
+		return User{authenticated: false}, errMalformedAuthorization
+	}
+
+	user, err := authClient.authenticate(req.Context(), bearerToken[1])
+	if err != nil {
+		return user, err
+	}
+
+	if user.authenticated == false {
+		switch {
+		case user.attributes.Username == "":
+			return user, errInvalidToken
+		case !user.attributes.Enabled:
+			return user, errUserDisabled
+		case user.attributes.Status != "CONFIRMED":
+			return user, errUserUnconfirmed
+		}
+		return user, errInvalidToken
+	}
+
+	return user, nil
+}
+
+// authResult is how the outcome of authenticateRequest is counted: "ok" or why it failed
+func authResult(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case errNoClientCertificate:
+		return "no_certificate"
+	case errNoAuthorization:
+		return "missing_header"
+	case errMalformedAuthorization:
+		return "malformed_header"
+	case errUserDisabled:
+		return "disabled"
+	case errUserUnconfirmed:
+		return "unconfirmed"
+	}
+
+	switch e := err.(type) {
+	case *jwt.ValidationError:
+		switch {
+		case e.Errors&jwt.ValidationErrorExpired != 0:
+			return "expired"
+		case e.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+			return "bad_signature"
+		case e.Errors&jwt.ValidationErrorMalformed != 0:
+			return "malformed_token"
+		}
+	case awserr.Error:
+		return "cognito_error"
+	}
+
+	return "invalid"
+}
+
+// certificateUser maps a verified client certificate to a User. The subject
+// and every SAN become attributes, the username comes from usernameField.
+func certificateUser(certificate *x509.Certificate, usernameField string) (User, error) {
+	attributes := UserAttributes{
+		Enabled:          true,
+		CreatedDate:      certificate.NotBefore,
+		LastModifiedDate: certificate.NotBefore,
+		Status:           "CONFIRMED",
+	}
+
+	add := func(name string, values ...string) {
+		for _, value := range values {
+			attributes.Attributes = append(attributes.Attributes, UserAttributeField{Name: name, Value: value})
+		}
+	}
+
+	var uris []string
+	for _, uri := range certificate.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	add("subject", certificate.Subject.String())
+	add("issuer", certificate.Issuer.String())
+	add("serialNumber", certificate.SerialNumber.String())
+	add("commonName", certificate.Subject.CommonName)
+	add("dnsName", certificate.DNSNames...)
+	add("email", certificate.EmailAddresses...)
+	add("uri", uris...)
+
+	if usernameField == "" {
+		usernameField = "commonName"
+	}
+	for _, field := range attributes.Attributes {
+		if field.Name == usernameField && field.Value != "" {
+			attributes.Username = field.Value
+			break
+		}
+	}
+
+	if attributes.Username == "" {
+		return User{authenticated: false}, fmt.Errorf("client certificate %s has no %s", certificate.Subject, usernameField)
+	}
+
+	return User{
+		authenticated: true,
+		claims: jwt.MapClaims{
+			"sub": attributes.Username,
+			"exp": float64(certificate.NotAfter.Unix()),
+		},
+		attributes: attributes,
+	}, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for the mTLS tests
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	file        string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+
+	file := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	return &testCA{certificate: certificate, key: key, file: file}
+}
+
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(2)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateUser(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/billing")
+	certificate := &x509.Certificate{
+		SerialNumber:   big.NewInt(7),
+		Subject:        pkix.Name{CommonName: "billing", Organization: []string{"Example"}},
+		DNSNames:       []string{"billing.internal"},
+		EmailAddresses: []string{"billing@example.com"},
+		URIs:           []*url.URL{spiffe},
+		NotAfter:       time.Unix(2000000000, 0),
+	}
+
+	cases := [][]string{
+		{"", "billing"},
+		{"commonName", "billing"},
+		{"dnsName", "billing.internal"},
+		{"email", "billing@example.com"},
+		{"uri", "spiffe://example.com/billing"},
+	}
+	for _, i := range cases {
+		user, err := certificateUser(certificate, i[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.authenticated || user.attributes.Username != i[1] {
+			t.Error("'" + user.attributes.Username + "' != '" + i[1] + "'")
+		}
+	}
+
+	user, _ := certificateUser(certificate, "")
+	if expires, ok := user.expiresAt(); !ok || expires.Unix() != 2000000000 {
+		t.Error("expected the user to expire with the certificate")
+	}
+
+	certificate.EmailAddresses = nil
+	if _, err := certificateUser(certificate, "email"); err == nil {
+		t.Error("expected a certificate without the username field to be rejected")
+	}
+}
+
+func TestMutualTLSAuthentication(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mtls")
+	defer os.RemoveAll(dir)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+
+	ca := newTestCA(t, dir)
+	tlsConfig := &TLSConfig{
+		Certificates: []CertificateConfig{writeCertificate(t, dir, 1, "api.example.com")},
+		ClientCAFile: ca.file,
+	}
+	config := &ProxyConfig{
+		Routes: []RouteConfig{
+			{Prefix: "/services", Auth: AuthMTLS},
+			{Prefix: "/shared", Auth: AuthBoth},
+		},
+		Upstreams: map[string]*UpstreamConfig{"default": testUpstream(t, upstream.URL)},
+		TLS:       tlsConfig,
+	}
+	previous := proxyConfig
+	proxyConfig = config
+	defer func() { proxyConfig = previous }()
+
+	serverConfig, err := tlsConfig.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(handleRequest))
+	base := "https://" + listener.Addr().String()
+
+	client := func(certificates ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certificates,
+		}}}
+	}
+	trusted := client(ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}))
+	anonymous := client()
+
+	for _, path := range []string{"/services/invoices", "/shared/invoices"} {
+		res, err := trusted.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		var attributes UserAttributes
+		if err := json.Unmarshal(body, &attributes); err != nil {
+			t.Fatalf("%s: upstream got %q", path, body)
+		}
+		if attributes.Username != "billing" || !attributes.Enabled {
+			t.Errorf("%s: unexpected identity %s", path, body)
+		}
+	}
+
+	cases := []struct {
+		client *http.Client
+		path   string
+	}{
+		{anonymous, "/services/invoices"},
+		{anonymous, "/shared/invoices"},
+		// Bearer only routes ignore certificates
+		{trusted, "/invoices"},
+	}
+	for _, i := range cases {
+		res, err := i.client.Get(base + i.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", i.path, res.StatusCode)
+		}
+	}
+
+	// A certificate from another CA doesn't get past the handshake
+	untrusted := client(newTestCA(t, dir).issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}))
+	if res, err := untrusted.Get(base + "/services/invoices"); err == nil {
+		res.Body.Close()
+		t.Error("expected a certificate from an unknown CA to be rejected")
+	}
+}
+
+func TestLoadProxyConfigAuth(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(dir)
+
+	cases := []string{
+		`{"routes":[{"prefix":"/","auth":"mtls"}]}`,
+		`{"routes":[{"prefix":"/","auth":"basic"}]}`,
+	}
+	for _, i := range cases {
+		path := filepath.Join(dir, "config.json")
+		ioutil.WriteFile(path, []byte(i), 0600)
+		if _, err := loadProxyConfig(path, &UpstreamConfig{URL: "http://backend"}); err == nil {
+			t.Error("expected " + i + " to be rejected")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"mime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// BodyLoggingConfig limits which request and response bodies are logged, and how much of them
+type BodyLoggingConfig struct {
+	// MaxBytes is how much of a body is logged before it is cut off with a
+	// marker. Defaults to 8192, -1 logs bodies in full.
+	MaxBytes int `json:"maxBytes"`
+	// SamplePercent is the share of requests whose bodies are logged, defaults to 100
+	SamplePercent *float64 `json:"samplePercent"`
+	// ErrorsOnly logs bodies only for exchanges answered with a status of 400 or more
+	ErrorsOnly bool `json:"errorsOnly"`
+	// AllowRoutes and DenyRoutes are path prefixes, when AllowRoutes is set other paths aren't logged
+	AllowRoutes []string `json:"allowRoutes"`
+	DenyRoutes  []string `json:"denyRoutes"`
+	// AllowContentTypes and DenyContentTypes are media types, "type/*" matches a whole type
+	AllowContentTypes []string `json:"allowContentTypes"`
+	DenyContentTypes  []string `json:"denyContentTypes"`
+	// SummarizeOther logs the content type and size of bodies that aren't JSON
+	SummarizeOther bool `json:"summarizeOther"`
+}
+
+// bodyLogPolicy is a compiled BodyLoggingConfig
+type bodyLogPolicy struct {
+	maxBytes      int
+	samplePercent float64
+	errorsOnly    bool
+	allowRoutes   []string
+	denyRoutes    []string
+	allowTypes    []string
+	denyTypes     []string
+	summarize     bool
+}
+
+// bodyLogging is the policy bodies are logged with, the defaults until init loads the config
+var bodyLogging, _ = (*BodyLoggingConfig)(nil).compile()
+
+// bodyLogDebug is switched on from the admin API to log the bodies of every
+// request, whatever the sampling, route and errors only settings. Content type
+// filters, redaction and truncation still apply.
+var bodyLogDebug int32
+
+func debuggingBodies() bool {
+	return atomic.LoadInt32(&bodyLogDebug) == 1
+}
+
+// compile checks the settings and fills in defaults. A nil config gives the defaults.
+func (c *BodyLoggingConfig) compile() (*bodyLogPolicy, error) {
+	if c == nil {
+		c = &BodyLoggingConfig{}
+	}
+
+	p := &bodyLogPolicy{
+		maxBytes:      8192,
+		samplePercent: 100,
+		errorsOnly:    c.ErrorsOnly,
+		allowRoutes:   c.AllowRoutes,
+		denyRoutes:    c.DenyRoutes,
+		summarize:     c.SummarizeOther,
+	}
+
+	if c.MaxBytes < -1 {
+		return nil, fmt.Errorf("body logging maxBytes must be -1 or more: %d", c.MaxBytes)
+	}
+	if c.MaxBytes != 0 {
+		p.maxBytes = c.MaxBytes
+	}
+
+	if c.SamplePercent != nil {
+		if *c.SamplePercent < 0 || *c.SamplePercent > 100 {
+			return nil, fmt.Errorf("body logging samplePercent must be between 0 and 100: %g", *c.SamplePercent)
+		}
+		p.samplePercent = *c.SamplePercent
+	}
+
+	for _, list := range []struct {
+		in  []string
+		out *[]string
+	}{{c.AllowContentTypes, &p.allowTypes}, {c.DenyContentTypes, &p.denyTypes}} {
+		for _, contentType := range list.in {
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				return nil, fmt.Errorf("bad body logging content type %s: %s", contentType, err)
+			}
+			*list.out = append(*list.out, mediaType)
+		}
+	}
+
+	return p, nil
+}
+
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// request reports whether bodies are logged for the request in ctx on path. The
+// sample is keyed on the request ID, so a request and its response agree.
+func (p *bodyLogPolicy) request(ctx context.Context, path string) bool {
+	if debuggingBodies() {
+		return true
+	}
+
+	if record := accessRecordFrom(ctx); record != nil {
+		path = record.path
+	}
+
+	if len(p.allowRoutes) > 0 && !hasAnyPrefix(path, p.allowRoutes) {
+		return false
+	}
+	if hasAnyPrefix(path, p.denyRoutes) {
+		return false
+	}
+
+	if p.samplePercent >= 100 {
+		return true
+	}
+	if p.samplePercent <= 0 {
+		return false
+	}
+
+	bucket := rand.Intn(10000)
+	if record := accessRecordFrom(ctx); record != nil {
+		h := fnv.New32a()
+		h.Write([]byte(record.id))
+		bucket = int(h.Sum32() % 10000)
+	}
+	return float64(bucket) < p.samplePercent*100
+}
+
+// onlyErrors reports whether bodies wait for an error response before they're logged
+func (p *bodyLogPolicy) onlyErrors() bool {
+	return p.errorsOnly && !debuggingBodies()
+}
+
+func matchesMediaType(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == mediaType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentType reports whether bodies of contentType may be logged
+func (p *bodyLogPolicy) contentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if len(p.allowTypes) > 0 && !matchesMediaType(mediaType, p.allowTypes) {
+		return false
+	}
+	return !matchesMediaType(mediaType, p.denyTypes)
+}
+
+// value returns what is logged for a JSON body: the redacted body, or its
+// redacted JSON cut off with a marker when that is longer than maxBytes
+func (p *bodyLogPolicy) value(body []byte) (interface{}, error) {
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+	parsed = redaction.body(parsed)
+
+	if p.maxBytes < 0 {
+		return parsed, nil
+	}
+
+	encoded, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) <= p.maxBytes {
+		return parsed, nil
+	}
+
+	cut := p.maxBytes
+	for cut > 0 && !utf8.RuneStart(encoded[cut]) {
+		cut--
+	}
+	return string(encoded[:cut]) + "...[truncated " + strconv.Itoa(len(encoded)-cut) + " bytes]", nil
+}
+
+// summary describes a body that isn't logged, nil unless summaries are on. A negative size is unknown.
+func (p *bodyLogPolicy) summary(contentType string, size int64) interface{} {
+	if !p.summarize {
+		return nil
+	}
+
+	summary := map[string]interface{}{"contentType": contentType}
+	if size >= 0 {
+		summary["bytes"] = size
+	}
+	return summary
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testBodyLogging(t *testing.T, c *BodyLoggingConfig) *bodyLogPolicy {
+	policy, err := c.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestBodyLogValue(t *testing.T) {
+	cases := []struct {
+		maxBytes int
+		body     string
+		out      string
+	}{
+		{0, `{"name":"ada"}`, `{"name":"ada"}`},
+		{20, `{"name":"ada","password":"hunter2"}`, `{"name":"ada","passw...[truncated 18 bytes]`},
+		{-1, `{"items":[1,2,3,4,5,6,7,8,9]}`, `{"items":[1,2,3,4,5,6,7,8,9]}`},
+		{13, `{"name":"été"}`, `{"name":"ét...[truncated 4 bytes]`},
+		{8, `[1,2,3,4,5,6]`, `[1,2,3,4...[truncated 5 bytes]`},
+	}
+	for _, i := range cases {
+		value, err := testBodyLogging(t, &BodyLoggingConfig{MaxBytes: i.maxBytes}).value([]byte(i.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, ok := value.(string)
+		if !ok {
+			b, _ := json.Marshal(value)
+			result = string(b)
+		}
+		if result != i.out {
+			t.Error("'" + result + "' != '" + i.out + "'")
+		}
+	}
+}
+
+func TestBodyLogContentType(t *testing.T) {
+	policy := testBodyLogging(t, &BodyLoggingConfig{
+		AllowContentTypes: []string{"application/*", "text/plain"},
+		DenyContentTypes:  []string{"application/x-www-form-urlencoded"},
+	})
+
+	cases := map[string]bool{
+		"application/json; charset=utf-8":   true,
+		"application/problem+json":          true,
+		"text/plain":                        true,
+		"text/html":                         false,
+		"application/x-www-form-urlencoded": false,
+	}
+	for contentType, logged := range cases {
+		if policy.contentType(contentType) != logged {
+			t.Errorf("%s: expected %v", contentType, logged)
+		}
+	}
+}
+
+func TestBodyLogSampling(t *testing.T) {
+	half := 50.0
+	policy := testBodyLogging(t, &BodyLoggingConfig{SamplePercent: &half, DenyRoutes: []string{"/health"}})
+
+	sampled := 0
+	for n := 0; n < 2000; n++ {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set(requestIDHeader, "req-"+strconv.Itoa(n))
+		ctx := newAccessRecord(req).context(req.Context())
+
+		first := policy.request(ctx, "/users")
+		if first != policy.request(ctx, "/users") {
+			t.Fatal("expected the request and response to agree")
+		}
+		if first {
+			sampled++
+		}
+	}
+	if sampled < 850 || sampled > 1150 {
+		t.Errorf("expected about half the requests to be sampled, got %d of 2000", sampled)
+	}
+
+	none := 0.0
+	ctx := httptest.NewRequest(http.MethodGet, "/", nil).Context()
+	if testBodyLogging(t, &BodyLoggingConfig{SamplePercent: &none}).request(ctx, "/users") {
+		t.Error("expected no bodies at 0%")
+	}
+
+	routes := testBodyLogging(t, &BodyLoggingConfig{AllowRoutes: []string{"/api"}, DenyRoutes: []string{"/api/auth"}})
+	cases := map[string]bool{"/api/users": true, "/api/auth/login": false, "/static": false}
+	for path, logged := range cases {
+		if routes.request(ctx, path) != logged {
+			t.Errorf("%s: expected %v", path, logged)
+		}
+	}
+}
+
+// loggedResponse decodes the response logged by logResponse in out
+func loggedResponse(t *testing.T, out *bytes.Buffer) map[string]interface{} {
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "upstream response" {
+			response, _ := record["response"].(map[string]interface{})
+			return response
+		}
+	}
+
+	t.Fatal("no response logged")
+	return nil
+}
+
+func TestBodyLoggingErrorsOnly(t *testing.T) {
+	previous, previousLogger := bodyLogging, logger
+	bodyLogging = testBodyLogging(t, &BodyLoggingConfig{ErrorsOnly: true, SummarizeOther: true})
+	l, out := testLogger(t, FormatJSON, LevelInfo)
+	logger = l
+	defer func() { bodyLogging, logger = previous, previousLogger }()
+
+	for _, status := range []int{http.StatusOK, http.StatusUnprocessableEntity} {
+		out.Reset()
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"ada"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(newAccessRecord(req).context(req.Context()))
+		logRequest(req)
+
+		if strings.Contains(out.String(), "ada") {
+			t.Error("expected the request body to wait for the response")
+		}
+
+		logResponse(&http.Response{
+			StatusCode:    status,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          ioutil.NopCloser(strings.NewReader(`{"error":"taken"}`)),
+			ContentLength: 17,
+			Request:       req,
+		})
+
+		response := loggedResponse(t, out)
+		requestBody, _ := json.Marshal(response["requestBody"])
+		responseBody, _ := json.Marshal(response["responseBody"])
+		if status >= 400 && (string(requestBody) != `{"name":"ada"}` || string(responseBody) != `{"error":"taken"}`) {
+			t.Errorf("%d: expected both bodies, got %s and %s", status, requestBody, responseBody)
+		}
+		if status < 400 && (response["requestBody"] != nil || response["responseBody"] != nil) {
+			t.Errorf("%d: expected no bodies, got %s and %s", status, requestBody, responseBody)
+		}
+	}
+
+	out.Reset()
+	logResponse(&http.Response{
+		StatusCode:    http.StatusInternalServerError,
+		Header:        http.Header{"Content-Type": {"text/csv"}},
+		Body:          ioutil.NopCloser(strings.NewReader("a,b\n")),
+		ContentLength: 4,
+	})
+
+	summary, _ := json.Marshal(loggedResponse(t, out)["responseBody"])
+	if string(summary) != `{"bytes":4,"contentType":"text/csv"}` {
+		t.Error("'" + string(summary) + "' != '{\"bytes\":4,\"contentType\":\"text/csv\"}'")
+	}
+}
+
+func TestBodyLoggingErrorsOnlyProxyErrors(t *testing.T) {
+	previous, previousLogger, previousPolicy := bodyLogging, logger, conversionPolicy
+	bodyLogging = testBodyLogging(t, &BodyLoggingConfig{ErrorsOnly: true})
+	l, out := testLogger(t, FormatJSON, LevelInfo)
+	logger, conversionPolicy = l, ConversionPolicy{Collisions: CollisionError}
+	defer func() { bodyLogging, logger, conversionPolicy = previous, previousLogger, previousPolicy }()
+
+	cases := []struct {
+		body   string
+		status int
+	}{
+		// Rejected before the request is logged
+		{`{"userId":1,"user_id":2}`, http.StatusBadRequest},
+		// Rejected after the request is logged
+		{`{"name":"ada"}`, http.StatusUnauthorized},
+	}
+	for _, i := range cases {
+		out.Reset()
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(i.body))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handleRequest(res, req)
+
+		if res.Code != i.status {
+			t.Fatalf("%s: expected %d, got %d", i.body, i.status, res.Code)
+		}
+
+		var rejected map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatal(err)
+			}
+			if record["msg"] == "rejected request" {
+				if rejected != nil {
+					t.Errorf("%s: expected the body to be logged once", i.body)
+				}
+				rejected = record
+			}
+		}
+
+		requestBody, _ := json.Marshal(rejected["requestBody"])
+		if string(requestBody) != i.body || rejected["status"] != float64(i.status) {
+			t.Errorf("%s: expected the request body with the status, got %v", i.body, rejected)
+		}
+	}
+}
+
+func TestBodyLoggingConfigValidation(t *testing.T) {
+	negative, over := -1.0, 101.0
+	cases := []*BodyLoggingConfig{
+		{MaxBytes: -2},
+		{SamplePercent: &negative},
+		{SamplePercent: &over},
+		{AllowContentTypes: []string{"not a type"}},
+	}
+	for _, i := range cases {
+		if _, err := i.compile(); err == nil {
+			t.Errorf("expected %+v to be rejected", i)
+		}
+	}
+}
@@ -2,35 +2,30 @@ package main
 
 import (
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Converts a string to CamelCase
 func toCamelInitCase(s string, initCase bool) string {
 	s = addWordBoundariesToNumbers(s)
 	s = strings.Trim(s, " ")
-	n := ""
+	var n strings.Builder
+	n.Grow(len(s))
 	capNext := initCase
 	for _, v := range s {
-		if v >= 'A' && v <= 'Z' {
-			n += string(v)
-		}
-		if v >= '0' && v <= '9' {
-			n += string(v)
-		}
-		if v >= 'a' && v <= 'z' {
-			if capNext {
-				n += strings.ToUpper(string(v))
-			} else {
-				n += string(v)
-			}
-		}
 		if v == '_' || v == ' ' || v == '-' {
 			capNext = true
+			continue
+		}
+		if capNext && unicode.IsLower(v) {
+			n.WriteRune(unicode.ToUpper(v))
 		} else {
-			capNext = false
+			n.WriteRune(v)
 		}
+		capNext = false
 	}
-	return n
+	return n.String()
 }
 
 // ToCamel converts a string to CamelCase
@@ -43,8 +38,8 @@ func ToLowerCamel(s string) string {
 	if s == "" {
 		return s
 	}
-	if r := rune(s[0]); r >= 'A' && r <= 'Z' {
-		s = strings.ToLower(string(r)) + s[1:]
+	if r, size := utf8.DecodeRuneInString(s); unicode.IsUpper(r) {
+		s = string(unicode.ToLower(r)) + s[size:]
 	}
 	return toCamelInitCase(s, false)
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"regexp"
 	"testing"
+	"testing/quick"
 )
 
 func TestToCamel(t *testing.T) {
@@ -42,3 +44,50 @@ func TestToLowerCamel(t *testing.T) {
 		}
 	}
 }
+
+func TestToCamelUnicode(t *testing.T) {
+	cases := [][]string{
+		{"größe_der_datei", "GrößeDerDatei"},
+		{"café au lait", "CaféAuLait"},
+		{"été-chaud", "ÉtéChaud"},
+		{"名前_フィールド", "名前フィールド"},
+		{"user.name", "User.name"},
+		{"straße2grün", "Straße2Grün"},
+	}
+	for _, i := range cases {
+		in := i[0]
+		out := i[1]
+		result := ToCamel(in)
+		if result != out {
+			t.Error("'" + result + "' != '" + out + "'")
+		}
+	}
+}
+
+func TestToLowerCamelUnicode(t *testing.T) {
+	cases := [][]string{
+		{"Éclair_size", "éclairSize"},
+		{"größe_der_datei", "größeDerDatei"},
+		{"Ωmega_value", "ωmegaValue"},
+		{"user.first_name", "user.firstName"},
+	}
+	for _, i := range cases {
+		in := i[0]
+		out := i[1]
+		result := ToLowerCamel(in)
+		if result != out {
+			t.Error("'" + result + "' != '" + out + "'")
+		}
+	}
+}
+
+func TestAddWordBoundariesToNumbers(t *testing.T) {
+	// The boundaries match the regular expression the converters used to run
+	numberSequence := regexp.MustCompile(`(\pL)(\p{Nd}+)(\pL?)`)
+	property := func(k identifier) bool {
+		return addWordBoundariesToNumbers(string(k)) == numberSequence.ReplaceAllString(string(k), "$1 $2 $3")
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
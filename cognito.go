@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"context"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
 	"github.com/dgrijalva/jwt-go"
@@ -18,6 +21,9 @@ type CognitoAppClient struct {
 	ClientID         string
 	WellKnownJWKs    *jwk.Set
 	IdentityProvider *cognitoidentityprovider.CognitoIdentityProvider
+
+	// jwksMu guards WellKnownJWKs, which can be refreshed while requests use it
+	jwksMu sync.RWMutex
 }
 
 // CognitoAppClientConfig handles the pool, region, and client
@@ -68,7 +74,7 @@ func NewCognitoAppClient(cfg *CognitoAppClientConfig) (*CognitoAppClient, error)
 	// Set the well known JSON web token key sets
 	err = c.getWellKnownJWTKs()
 	if err != nil {
-		log.Println("error getting well known JWTKs", err)
+		logger.Error("error getting well known JWTKs", "error", err)
 	}
 
 	return c, err
@@ -89,21 +95,30 @@ func (c *CognitoAppClient) getWellKnownJWTKs() error {
 	// Use this cool package
 	set, err := jwk.Fetch(wkjwksURL)
 	if err == nil {
+		c.jwksMu.Lock()
 		c.WellKnownJWKs = set
+		c.jwksMu.Unlock()
 	} else {
-		log.Println("there was a problem getting the well known JSON web token key set")
-		log.Println(err)
+		logger.Error("there was a problem getting the well known JSON web token key set", "url", wkjwksURL, "error", err)
 	}
 	return err
 }
 
-func (c *CognitoAppClient) authenticate(token string) (User, error) {
-	parsedToken, err := parseJWT(token, c.WellKnownJWKs)
-	if err != nil {
-		return User{authenticated: false}, err
-	}
+// keySet returns the well known JSON web token key set in use
+func (c *CognitoAppClient) keySet() *jwk.Set {
+	c.jwksMu.RLock()
+	defer c.jwksMu.RUnlock()
+	return c.WellKnownJWKs
+}
 
-	validatedToken, err := validateJWT(parsedToken, c.ClientID)
+func (c *CognitoAppClient) authenticate(ctx context.Context, token string) (User, error) {
+	_, verification := startSpan(ctx, "verify jwt", SpanKindInternal)
+	validatedToken, err := parseJWT(token, c.keySet())
+	if err == nil {
+		validatedToken, err = validateJWT(validatedToken, c.ClientID)
+	}
+	verification.SetError(err)
+	verification.End()
 	if err != nil {
 		return User{authenticated: false}, err
 	}
@@ -113,6 +128,37 @@ func (c *CognitoAppClient) authenticate(token string) (User, error) {
 		return User{authenticated: false}, err
 	}
 
+	attributes, cached := userAttributes.get(username)
+	if !cached {
+		attributes, err = c.lookupUser(ctx, username)
+		if err != nil {
+			return User{authenticated: false}, err
+		}
+		userAttributes.add(username, attributes)
+	}
+
+	user := User{
+		authenticated: true,
+		claims:        validatedToken.Claims,
+		attributes:    attributes,
+	}
+
+	if !user.attributes.Enabled {
+		logger.Warn("user is disabled", "username", user.attributes.Username)
+		user.authenticated = false
+	}
+
+	// user status: UNCONFIRMED | CONFIRMED | ARCHIVED | COMPROMISED | UNKNOWN | RESET_REQUIRED | FORCE_CHANGE_PASSWORD
+	if user.attributes.Status != "CONFIRMED" {
+		logger.Warn("user is not in a CONFIRMED state", "username", user.attributes.Username, "status", user.attributes.Status)
+		user.authenticated = false
+	}
+
+	return user, nil
+}
+
+// lookupUser fetches the attributes of username with AdminGetUser
+func (c *CognitoAppClient) lookupUser(ctx context.Context, username string) (UserAttributes, error) {
 	parameters := &cognitoidentityprovider.AdminGetUserInput{
 		UserPoolId: &c.UserPoolID,
 		Username:   &username,
@@ -120,9 +166,20 @@ func (c *CognitoAppClient) authenticate(token string) (User, error) {
 
 	req, resp := c.IdentityProvider.AdminGetUserRequest(parameters)
 
-	err = req.Send()
+	_, lookup := startSpan(ctx, "cognito AdminGetUser", SpanKindClient,
+		"rpc.system", "aws-api", "rpc.service", "CognitoIdentityProvider", "rpc.method", "AdminGetUser")
+	started := time.Now()
+	err := req.Send()
+	cognitoDuration.observe(time.Since(started).Seconds())
+	lookup.SetError(err)
+	lookup.End()
 	if err != nil {
-		return User{authenticated: false}, err
+		code := "unknown"
+		if aerr, ok := err.(awserr.Error); ok {
+			code = aerr.Code()
+		}
+		cognitoErrors.inc(code)
+		return UserAttributes{}, err
 	}
 
 	attributes := UserAttributes{
@@ -140,22 +197,5 @@ func (c *CognitoAppClient) authenticate(token string) (User, error) {
 		})
 	}
 
-	user := User{
-		authenticated: true,
-		claims:        validatedToken.Claims,
-		attributes:    attributes,
-	}
-
-	if !user.attributes.Enabled {
-		log.Printf("user: %s is disabled", user.attributes.Username)
-		user.authenticated = false
-	}
-
-	// user status: UNCONFIRMED | CONFIRMED | ARCHIVED | COMPROMISED | UNKNOWN | RESET_REQUIRED | FORCE_CHANGE_PASSWORD
-	if user.attributes.Status != "CONFIRMED" {
-		log.Printf("user: %s is not in a CONFIRMED state", user.attributes.Username)
-		user.authenticated = false
-	}
-
-	return user, nil
+	return attributes, nil
 }
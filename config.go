@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ProxyConfig is read from the JSON file named by the CONFIG_FILE environment variable
+type ProxyConfig struct {
+	Routes    []RouteConfig              `json:"routes"`
+	Upstreams map[string]*UpstreamConfig `json:"upstreams"`
+	TLS       *TLSConfig                 `json:"tls"`
+	// IdentityAssertion, when set, sends upstreams a signed JWT instead of the user attributes as JSON
+	IdentityAssertion *IdentityAssertionConfig `json:"identityAssertion"`
+	// IdentityHeaders are set on every upstream request from the user's claims and attributes
+	IdentityHeaders []IdentityHeaderConfig `json:"identityHeaders"`
+	// ForwardAuthorization is what upstreams get in the Authorization header: "json" for the
+	// user attributes, "assertion" for a signed JWT or "none". Defaults to "assertion" when
+	// IdentityAssertion is set and "json" otherwise.
+	ForwardAuthorization string `json:"forwardAuthorization"`
+	// Redaction hides secrets and personal data in logs, on top of the built in defaults
+	Redaction *RedactionConfig `json:"redaction"`
+	// BodyLogging limits the request and response bodies that are logged
+	BodyLogging *BodyLoggingConfig `json:"bodyLogging"`
+
+	redaction   *redactionPolicy
+	bodyLogging *bodyLogPolicy
+}
+
+// RouteConfig holds the settings for requests whose path starts with Prefix
+type RouteConfig struct {
+	Prefix string `json:"prefix"`
+	// Upstream names an entry of Upstreams, routes without one go to the default upstream
+	Upstream     string `json:"upstream"`
+	ConvertQuery bool   `json:"convertQuery"`
+	ConvertForm  bool   `json:"convertForm"`
+	// JSONHeaders are response headers whose JSON values get the same key conversion as the body
+	JSONHeaders []string `json:"jsonHeaders"`
+	// Auth is "bearer" (the default), "mtls" or "both". Client certificates need tls.clientCAFile.
+	Auth string `json:"auth"`
+}
+
+var proxyConfig = &ProxyConfig{}
+
+// loadProxyConfig reads the config file at path, if any. The default upstream is
+// used for routes that don't name one, unless the file defines its own "default".
+func loadProxyConfig(path string, defaultUpstream *UpstreamConfig) (*ProxyConfig, error) {
+	config := &ProxyConfig{}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(b, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Upstreams == nil {
+		config.Upstreams = make(map[string]*UpstreamConfig)
+	}
+	if _, ok := config.Upstreams["default"]; !ok {
+		config.Upstreams["default"] = defaultUpstream
+	}
+
+	for name, upstream := range config.Upstreams {
+		if err := upstream.prepare(); err != nil {
+			return nil, fmt.Errorf("upstream %s: %s", name, err)
+		}
+	}
+
+	if config.IdentityAssertion != nil {
+		if err := config.IdentityAssertion.prepare(); err != nil {
+			return nil, fmt.Errorf("identity assertion: %s", err)
+		}
+	}
+
+	policy, err := config.Redaction.compile()
+	if err != nil {
+		return nil, err
+	}
+	config.redaction = policy
+
+	config.bodyLogging, err = config.BodyLogging.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, header := range config.IdentityHeaders {
+		if err := header.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.ForwardAuthorization {
+	case "", ForwardJSON, ForwardNone:
+	case ForwardAssertion:
+		if config.IdentityAssertion == nil {
+			return nil, errors.New("forwarding an assertion needs identityAssertion")
+		}
+	default:
+		return nil, fmt.Errorf("unknown forwardAuthorization: %s", config.ForwardAuthorization)
+	}
+
+	for _, route := range config.Routes {
+		switch route.Auth {
+		case "", AuthBearer:
+		case AuthMTLS, AuthBoth:
+			if config.TLS == nil || config.TLS.ClientCAFile == "" {
+				return nil, fmt.Errorf("route %s: %s auth needs tls.clientCAFile", route.Prefix, route.Auth)
+			}
+		default:
+			return nil, fmt.Errorf("route %s: unknown auth %s", route.Prefix, route.Auth)
+		}
+
+		if route.Upstream == "" {
+			continue
+		}
+		if _, ok := config.Upstreams[route.Upstream]; !ok {
+			return nil, fmt.Errorf("route %s: unknown upstream %s", route.Prefix, route.Upstream)
+		}
+	}
+
+	return config, nil
+}
+
+// route returns the route with the longest prefix matching path, or the defaults when none match
+func (c *ProxyConfig) route(path string) *RouteConfig {
+	var match *RouteConfig
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		if matchesPrefix(path, r.Prefix) && (match == nil || len(r.Prefix) > len(match.Prefix)) {
+			match = r
+		}
+	}
+
+	if match == nil {
+		return &RouteConfig{}
+	}
+
+	return match
+}
+
+// matchesPrefix reports whether path is under prefix, only matching whole path
+// segments so /api doesn't match /apiary
+func matchesPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// forwardAuthorization returns how the Authorization header is sent upstream
+func (c *ProxyConfig) forwardAuthorization() string {
+	if c.ForwardAuthorization != "" {
+		return c.ForwardAuthorization
+	}
+
+	if c.IdentityAssertion != nil {
+		return ForwardAssertion
+	}
+
+	return ForwardJSON
+}
+
+// upstream returns the upstream requests on route are proxied to
+func (c *ProxyConfig) upstream(route *RouteConfig) *UpstreamConfig {
+	if route.Upstream == "" {
+		return c.Upstreams["default"]
+	}
+
+	return c.Upstreams[route.Upstream]
+}
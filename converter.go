@@ -1,33 +1,281 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
-func convertKeys(j json.RawMessage, t string) json.RawMessage {
-	m := make(map[string]json.RawMessage)
-	if err := json.Unmarshal([]byte(j), &m); err != nil {
+// CollisionPolicy decides what convertKeys does when two keys of one object convert to the same name
+type CollisionPolicy int
+
+const (
+	// CollisionError fails the conversion
+	CollisionError CollisionPolicy = iota
+	// CollisionKeepFirst keeps the first key in document order and drops the others
+	CollisionKeepFirst
+	// CollisionKeepOriginal leaves every colliding key with its original name
+	CollisionKeepOriginal
+)
+
+// ConversionPolicy controls how convertKeys renames object keys
+type ConversionPolicy struct {
+	Collisions CollisionPolicy
+	// RoundTrip only renames a key when converting it back gives the original key
+	RoundTrip bool
+}
+
+// KeyCollisionError reports keys of one object that convert to the same name
+type KeyCollisionError struct {
+	Keys      []string
+	Converted string
+}
+
+func (e *KeyCollisionError) Error() string {
+	return fmt.Sprintf("keys %q all convert to %q", e.Keys, e.Converted)
+}
+
+// keyList is the colliding keys quoted and separated by commas, for error messages to clients
+func (e *KeyCollisionError) keyList() string {
+	quoted := make([]string, len(e.Keys))
+	for i, key := range e.Keys {
+		quoted[i] = strconv.Quote(key)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+var keyStyles = map[string]func(string) string{
+	"snake": ToSnake,
+	"camel": ToLowerCamel,
+}
+
+var inverseKeyStyles = map[string]string{
+	"snake": "camel",
+	"camel": "snake",
+}
+
+var conversionPolicy = ConversionPolicy{Collisions: CollisionKeepOriginal}
+
+var convertedKeys = newKeyCache(4096)
+
+func parseCollisionPolicy(s string) (CollisionPolicy, error) {
+	switch s {
+	case "error":
+		return CollisionError, nil
+	case "first":
+		return CollisionKeepFirst, nil
+	case "original":
+		return CollisionKeepOriginal, nil
+	}
+
+	return CollisionError, fmt.Errorf("unknown key collision policy: %s", s)
+}
+
+// convertKey renames a single key to the style t. In round trip mode the key is
+// left alone unless the inverse conversion turns the new name back into it.
+func convertKey(k string, t string, roundTrip bool) string {
+	convert, ok := keyStyles[t]
+	if !ok {
+		return k
+	}
+
+	cacheKey := keyCacheKey{style: t, roundTrip: roundTrip, key: k}
+	if fixed, ok := convertedKeys.get(cacheKey); ok {
+		return fixed
+	}
+
+	fixed := convert(k)
+	if roundTrip && keyStyles[inverseKeyStyles[t]](fixed) != k {
+		fixed = k
+	}
+
+	convertedKeys.add(cacheKey, fixed)
+	return fixed
+}
+
+func convertKeys(j json.RawMessage, t string, p ConversionPolicy) (json.RawMessage, error) {
+	if !json.Valid(j) {
+		return j, nil
+	}
+
+	return convertObject(j, t, p)
+}
+
+// convertObject does the work of convertKeys on input that is known to be valid JSON
+func convertObject(j json.RawMessage, t string, p ConversionPolicy) (json.RawMessage, error) {
+	keys, values, ok := splitObject(j)
+	if !ok {
 		// Not a JSON object
-		return j
+		return j, nil
 	}
 
-	for k, v := range m {
-		fixed := k
+	// Settle the name of every key before writing anything
+	names := make([]string, len(keys))
+	keep := make([]bool, len(keys))
+	owners := make(map[string]int, len(keys))
+	keptOriginals := false
+	for i, k := range keys {
+		name := convertKey(k, t, p.RoundTrip)
+		first, seen := owners[name]
+		switch {
+		case !seen:
+			owners[name] = i
+			names[i] = name
+			keep[i] = true
+		case p.Collisions == CollisionKeepFirst:
+		case p.Collisions == CollisionKeepOriginal:
+			names[first] = keys[first]
+			names[i] = k
+			keep[i] = true
+			keptOriginals = true
+		default:
+			return j, &KeyCollisionError{Keys: []string{keys[first], k}, Converted: name}
+		}
+	}
+
+	// An original name can still clash with the converted name of another key
+	if keptOriginals {
+		written := make(map[string]int, len(names))
+		for i, name := range names {
+			if first, seen := written[name]; seen && keep[i] {
+				return j, &KeyCollisionError{Keys: []string{keys[first], keys[i]}, Converted: name}
+			} else if keep[i] {
+				written[name] = i
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	buffer.Grow(len(j))
+	buffer.WriteByte('{')
+	for i, name := range names {
+		if !keep[i] {
+			continue
+		}
+
+		if buffer.Len() > 1 {
+			buffer.WriteByte(',')
+		}
+		writeJSONString(&buffer, name)
+		buffer.WriteByte(':')
+
+		// Converted objects come back compact and scalars have no whitespace to drop
+		switch values[i][0] {
+		case '[':
+			json.Compact(&buffer, values[i])
+			continue
+		case '{':
+		default:
+			buffer.Write(values[i])
+			continue
+		}
+
+		value, err := convertObject(values[i], t, p)
+		if err != nil {
+			return j, err
+		}
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+
+	return json.RawMessage(buffer.Bytes()), nil
+}
+
+// splitObject returns the keys and raw values of a JSON object in document
+// order. A repeated key keeps its first position and its last value, matching
+// encoding/json. j must be valid JSON, which lets it skip over values without
+// decoding them.
+func splitObject(j []byte) ([]string, []json.RawMessage, bool) {
+	i := skipSpace(j, 0)
+	if i == len(j) || j[i] != '{' {
+		return nil, nil, false
+	}
 
-		if t == "snake" {
-			fixed = ToSnake(k)
-		} else if t == "camel" {
-			fixed = ToLowerCamel(k)
+	var keys []string
+	var values []json.RawMessage
+	index := make(map[string]int)
+	for i = skipSpace(j, i+1); j[i] != '}'; i = skipSpace(j, i) {
+		if j[i] == ',' {
+			i = skipSpace(j, i+1)
 		}
 
-		delete(m, k)
-		m[fixed] = convertKeys(v, t)
+		end := skipValue(j, i)
+		key := string(j[i+1 : end-1])
+		if bytes.IndexByte(j[i:end], '\\') >= 0 {
+			json.Unmarshal(j[i:end], &key)
+		}
+
+		// Skip the colon between the key and its value
+		i = skipSpace(j, skipSpace(j, end)+1)
+		end = skipValue(j, i)
+
+		if first, seen := index[key]; seen {
+			values[first] = json.RawMessage(j[i:end])
+		} else {
+			index[key] = len(keys)
+			keys = append(keys, key)
+			values = append(values, json.RawMessage(j[i:end]))
+		}
+		i = end
 	}
 
-	b, err := json.Marshal(m)
-	if err != nil {
-		return j
+	return keys, values, true
+}
+
+func skipSpace(j []byte, i int) int {
+	for i < len(j) && (j[i] == ' ' || j[i] == '\t' || j[i] == '\n' || j[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// skipValue returns the index just past the JSON value starting at j[i]
+func skipValue(j []byte, i int) int {
+	switch j[i] {
+	case '"':
+		for i++; j[i] != '"'; i++ {
+			if j[i] == '\\' {
+				i++
+			}
+		}
+		return i + 1
+	case '{', '[':
+		depth := 0
+		for ; ; i++ {
+			switch j[i] {
+			case '"':
+				i = skipValue(j, i) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+	}
+
+	for i < len(j) && j[i] != ',' && j[i] != '}' && j[i] != ']' && j[i] != ' ' && j[i] != '\t' && j[i] != '\n' && j[i] != '\r' {
+		i++
+	}
+	return i
+}
+
+// writeJSONString writes s as a quoted JSON string, skipping encoding/json for plain keys
+func writeJSONString(buffer *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' || c >= utf8.RuneSelf {
+			encoded, _ := json.Marshal(s)
+			buffer.Write(encoded)
+			return
+		}
 	}
 
-	return json.RawMessage(b)
+	buffer.WriteByte('"')
+	buffer.WriteString(s)
+	buffer.WriteByte('"')
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestConvertKeys(t *testing.T) {
+	cases := [][]string{
+		{`{"fooBar":1}`, "snake", `{"foo_bar":1}`},
+		{`{"foo_bar":{"nestedKey":true}}`, "camel", `{"fooBar":{"nestedKey":true}}`},
+		{`{"b": 1, "a": 2}`, "snake", `{"b":1,"a":2}`},
+		{`{"a":1,"a":2}`, "snake", `{"a":2}`},
+		{`[{"fooBar":1}]`, "snake", `[{"fooBar":1}]`},
+		{`"fooBar"`, "snake", `"fooBar"`},
+	}
+	for _, i := range cases {
+		result, err := convertKeys(json.RawMessage(i[0]), i[1], ConversionPolicy{})
+		if err != nil {
+			t.Error(err)
+		}
+		if string(result) != i[2] {
+			t.Error("'" + i[0] + "' ('" + string(result) + "' != '" + i[2] + "')")
+		}
+	}
+}
+
+func TestConvertKeysCollisions(t *testing.T) {
+	body := json.RawMessage(`{"userId":1,"user_id":2,"name":3}`)
+
+	if _, err := convertKeys(body, "snake", ConversionPolicy{Collisions: CollisionError}); err == nil {
+		t.Error("expected a collision error")
+	} else if _, ok := err.(*KeyCollisionError); !ok {
+		t.Error(err)
+	}
+
+	cases := []struct {
+		policy CollisionPolicy
+		out    string
+	}{
+		{CollisionKeepFirst, `{"user_id":1,"name":3}`},
+		{CollisionKeepOriginal, `{"userId":1,"user_id":2,"name":3}`},
+	}
+	for _, i := range cases {
+		result, err := convertKeys(body, "snake", ConversionPolicy{Collisions: i.policy})
+		if err != nil {
+			t.Error(err)
+		}
+		if string(result) != i.out {
+			t.Error("'" + string(result) + "' != '" + i.out + "'")
+		}
+	}
+
+	// Repeated keys collapse to their last value before collisions are looked for
+	repeated := json.RawMessage(`{"userId":1,"user_id":2,"user_id":3}`)
+	for _, i := range []struct {
+		policy CollisionPolicy
+		out    string
+	}{
+		{CollisionKeepFirst, `{"user_id":1}`},
+		{CollisionKeepOriginal, `{"userId":1,"user_id":3}`},
+	} {
+		result, err := convertKeys(repeated, "snake", ConversionPolicy{Collisions: i.policy})
+		if err != nil {
+			t.Error(err)
+		}
+		if string(result) != i.out {
+			t.Error("'" + string(result) + "' != '" + i.out + "'")
+		}
+	}
+
+	result, err := convertKeys(json.RawMessage(`{"user_id":1,"user_id":2}`), "snake", ConversionPolicy{Collisions: CollisionError})
+	if err != nil || string(result) != `{"user_id":2}` {
+		t.Error("expected a repeated key not to be a collision, got", string(result), err)
+	}
+
+	nested := json.RawMessage(`{"outer":{"fooBar":1,"foo_bar":2}}`)
+	if _, err := convertKeys(nested, "snake", ConversionPolicy{Collisions: CollisionError}); err == nil {
+		t.Error("expected a collision error in a nested object")
+	}
+}
+
+func TestConvertKeyRoundTrip(t *testing.T) {
+	cases := [][]string{
+		{"fooBar", "snake", "foo_bar"},
+		{"numbers2And55with000", "snake", "numbers2And55with000"},
+		{"userID", "snake", "userID"},
+		{"foo_bar", "camel", "fooBar"},
+		{"numbers2and55with000", "camel", "numbers2and55with000"},
+	}
+	for _, i := range cases {
+		result := convertKey(i[0], i[1], true)
+		if result != i[2] {
+			t.Error("'" + i[0] + "' ('" + result + "' != '" + i[2] + "')")
+		}
+	}
+}
+
+// identifier is a random key mixing ASCII, accented and CJK characters
+type identifier string
+
+func (identifier) Generate(r *rand.Rand, size int) reflect.Value {
+	alphabet := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_- .éßÜΩω名前")
+	b := make([]rune, 1+r.Intn(size+1))
+	for i := range b {
+		b[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return reflect.ValueOf(identifier(string(b)))
+}
+
+// camelIdentifier is a random key already in lowerCamelCase
+type camelIdentifier string
+
+func (camelIdentifier) Generate(r *rand.Rand, size int) reflect.Value {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	var words []string
+	for n := 1 + r.Intn(4); len(words) < n; {
+		if len(words) > 0 && r.Intn(4) == 0 && !strings.ContainsAny(words[len(words)-1], "0123456789") {
+			words = append(words, string('1'+byte(r.Intn(9))))
+			continue
+		}
+		w := make([]byte, 1+r.Intn(6))
+		for i := range w {
+			w[i] = letters[r.Intn(len(letters))]
+		}
+		if len(words) > 0 {
+			w[0] -= 'a' - 'A'
+		}
+		words = append(words, string(w))
+	}
+	return reflect.ValueOf(camelIdentifier(strings.Join(words, "")))
+}
+
+func TestConvertKeyRoundTripProperty(t *testing.T) {
+	// A renamed key always converts back to the key it came from
+	reversible := func(k identifier) bool {
+		for style, inverse := range inverseKeyStyles {
+			fixed := convertKey(string(k), style, true)
+			if fixed != string(k) && convertKey(fixed, inverse, false) != string(k) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(reversible, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Keys from a camelCase upstream survive a trip to a snake_case client and back
+	survives := func(k camelIdentifier) bool {
+		out := convertKey(string(k), "snake", true)
+		return convertKey(out, "camel", true) == string(k)
+	}
+	if err := quick.Check(survives, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConvertKeysRoundTripProperty(t *testing.T) {
+	policy := ConversionPolicy{Collisions: CollisionError, RoundTrip: true}
+	property := func(keys []camelIdentifier) bool {
+		object := make(map[string]int, len(keys))
+		for i, k := range keys {
+			object[string(k)] = i
+		}
+		body, _ := json.Marshal(object)
+
+		snake, err := convertKeys(body, "snake", policy)
+		if err != nil {
+			return false
+		}
+		camel, err := convertKeys(snake, "camel", policy)
+		if err != nil {
+			return false
+		}
+
+		result := make(map[string]int)
+		if err := json.Unmarshal(camel, &result); err != nil {
+			return false
+		}
+		return reflect.DeepEqual(object, result)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// benchmarkPayload is a typical upstream response, a page of records with nested objects
+var benchmarkPayload = func() json.RawMessage {
+	type address struct {
+		StreetName   string `json:"streetName"`
+		PostalCode   string `json:"postalCode"`
+		CountryCode  string `json:"countryCode"`
+		IsPrimary    bool   `json:"isPrimary"`
+		LastVerified string `json:"lastVerifiedAt"`
+	}
+	type record struct {
+		UserID        int       `json:"userId"`
+		FirstName     string    `json:"firstName"`
+		LastName      string    `json:"lastName"`
+		EmailAddress  string    `json:"emailAddress"`
+		PhoneNumber   string    `json:"phoneNumber"`
+		CreatedAt     string    `json:"createdAt"`
+		UpdatedAt     string    `json:"updatedAt"`
+		AccountStatus string    `json:"accountStatus"`
+		Addresses     []address `json:"addresses"`
+		Preferences   struct {
+			MarketingOptIn bool   `json:"marketingOptIn"`
+			PreferredLang  string `json:"preferredLanguage"`
+			TimeZone       string `json:"timeZone"`
+		} `json:"preferences"`
+	}
+	page := struct {
+		TotalCount int `json:"totalCount"`
+		PageInfo   struct {
+			NextCursor  string `json:"nextCursor"`
+			HasNextPage bool   `json:"hasNextPage"`
+		} `json:"pageInfo"`
+		Items map[string]record `json:"itemsById"`
+	}{Items: make(map[string]record)}
+	for i := 0; i < 25; i++ {
+		r := record{UserID: i, FirstName: "Ada", LastName: "Lovelace", AccountStatus: "active"}
+		r.Addresses = []address{{StreetName: "Main", PostalCode: "12345", CountryCode: "US"}}
+		page.Items["user"+strconv.Itoa(i)] = r
+	}
+	b, _ := json.Marshal(page)
+	return b
+}()
+
+func benchmarkConvertKeys(b *testing.B, cacheSize int) {
+	previous := convertedKeys
+	convertedKeys = newKeyCache(cacheSize)
+	defer func() { convertedKeys = previous }()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkPayload)))
+	for n := 0; n < b.N; n++ {
+		snake, _ := convertKeys(benchmarkPayload, "snake", conversionPolicy)
+		convertKeys(snake, "camel", conversionPolicy)
+	}
+}
+
+func BenchmarkConvertKeysCached(b *testing.B) {
+	benchmarkConvertKeys(b, 4096)
+}
+
+func BenchmarkConvertKeysUncached(b *testing.B) {
+	benchmarkConvertKeys(b, 0)
+}
+
+func BenchmarkToSnake(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		ToSnake("numbers2And55with000LastVerifiedAt")
+	}
+}
+
+func BenchmarkToLowerCamel(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		ToLowerCamel("numbers_2_and_55_with_000_last_verified_at")
+	}
+}
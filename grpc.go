@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcStatusCodes maps the statuses the proxy answers with itself to gRPC codes
+var grpcStatusCodes = map[int]int{
+	http.StatusBadRequest:          3,  // INVALID_ARGUMENT
+	http.StatusUnauthorized:        16, // UNAUTHENTICATED
+	http.StatusForbidden:           7,  // PERMISSION_DENIED
+	http.StatusNotFound:            12, // UNIMPLEMENTED
+	http.StatusTooManyRequests:     8,  // RESOURCE_EXHAUSTED
+	http.StatusInternalServerError: 13, // INTERNAL
+	http.StatusBadGateway:          14, // UNAVAILABLE
+	http.StatusServiceUnavailable:  14, // UNAVAILABLE
+	http.StatusGatewayTimeout:      14, // UNAVAILABLE
+}
+
+// isGRPCRequest reports whether the request is a gRPC call, eg application/grpc or application/grpc+proto
+func isGRPCRequest(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcErrorResponse answers a gRPC call with a trailers-only response, gRPC
+// clients expect HTTP 200 with the outcome in the grpc-status header
+func grpcErrorResponse(status int, message string, res http.ResponseWriter) {
+	code, ok := grpcStatusCodes[status]
+	if !ok {
+		code = 2 // UNKNOWN
+	}
+
+	res.Header().Set("Content-Type", "application/grpc")
+	res.Header().Set("Grpc-Status", strconv.Itoa(code))
+	res.Header().Set("Grpc-Message", message)
+	res.WriteHeader(http.StatusOK)
+}
@@ -19,6 +19,7 @@ var gzPool = sync.Pool{
 type gzipResponseWriter struct {
 	io.Writer
 	http.ResponseWriter
+	written int64
 }
 
 func (w *gzipResponseWriter) WriteHeader(status int) {
@@ -27,13 +28,39 @@ func (w *gzipResponseWriter) WriteHeader(status int) {
 }
 
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+	n, err := w.Writer.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// countingWriter counts the compressed bytes on their way to the client
+type countingWriter struct {
+	io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush pushes whatever has been compressed so far through to the client
+func (w *gzipResponseWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		gz.Flush()
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
 // Gzip middleware to compress response body
 func Gzip(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// Upgraded connections carry their own protocol and need the raw connection
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || isUpgradeRequest(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -43,9 +70,17 @@ func Gzip(next http.Handler) http.Handler {
 		gz := gzPool.Get().(*gzip.Writer)
 		defer gzPool.Put(gz)
 
-		gz.Reset(w)
-		defer gz.Close()
+		compressed := &countingWriter{Writer: w}
+		gz.Reset(compressed)
+
+		gzw := &gzipResponseWriter{ResponseWriter: w, Writer: gz}
+		defer func() {
+			gz.Close()
+			if gzw.written > 0 {
+				gzipRatio.observe(float64(compressed.written) / float64(gzw.written))
+			}
+		}()
 
-		next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, Writer: gz}, r)
+		next.ServeHTTP(gzw, r)
 	})
 }
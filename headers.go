@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// convertJSONHeader converts the keys of every JSON object value of the named header
+func convertJSONHeader(header http.Header, name string, t string, p ConversionPolicy) error {
+	values := header[http.CanonicalHeaderKey(name)]
+	for i, value := range values {
+		if !IsJSON([]byte(value)) {
+			continue
+		}
+
+		converted, err := convertKeys(json.RawMessage(value), t, p)
+		if err != nil {
+			return err
+		}
+		values[i] = string(converted)
+	}
+
+	return nil
+}
+
+// convertLinkHeader renames the query parameters of every target URL in a Link
+// header value, eg `<https://example.com/items?pageSize=20>; rel="next"`
+func convertLinkHeader(value string, t string, p ConversionPolicy) (string, error) {
+	var b strings.Builder
+	b.Grow(len(value))
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(value):
+			// keep escaped characters inside parameter values as they are
+			b.WriteByte(c)
+			i++
+			c = value[i]
+		case c == '"':
+			quoted = !quoted
+		case c == '<' && !quoted:
+			end := strings.IndexByte(value[i:], '>')
+			if end < 0 {
+				break
+			}
+
+			target, err := convertURLQuery(value[i+1:i+end], t, p)
+			if err != nil {
+				return value, err
+			}
+
+			b.WriteByte('<')
+			b.WriteString(target)
+			b.WriteByte('>')
+			i += end
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String(), nil
+}
+
+// convertResponseHeaders brings the query parameters in redirect and pagination
+// URLs, and the keys of configured JSON headers, in line with the body
+func convertResponseHeaders(header http.Header, route *RouteConfig) error {
+	for _, name := range route.JSONHeaders {
+		if err := convertJSONHeader(header, name, "snake", conversionPolicy); err != nil {
+			return err
+		}
+	}
+
+	if !route.ConvertQuery {
+		return nil
+	}
+
+	if location := header.Get("Location"); location != "" {
+		location, err := convertURLQuery(location, "snake", conversionPolicy)
+		if err != nil {
+			return err
+		}
+		header.Set("Location", location)
+	}
+
+	links := header["Link"]
+	for i, link := range links {
+		converted, err := convertLinkHeader(link, "snake", conversionPolicy)
+		if err != nil {
+			return err
+		}
+		links[i] = converted
+	}
+
+	return nil
+}
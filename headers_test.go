@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestConvertLinkHeader(t *testing.T) {
+	cases := [][]string{
+		{
+			`<https://api.example.com/items?pageSize=20&afterCursor=abc>; rel="next", <https://api.example.com/items?pageSize=20>; rel="first"`,
+			`<https://api.example.com/items?page_size=20&after_cursor=abc>; rel="next", <https://api.example.com/items?page_size=20>; rel="first"`,
+		},
+		{
+			`</items?sortOrder=asc>; rel="prev"; title="see <pageSize=1>"`,
+			`</items?sort_order=asc>; rel="prev"; title="see <pageSize=1>"`,
+		},
+		{`<https://api.example.com/items>; rel="self"`, `<https://api.example.com/items>; rel="self"`},
+	}
+	for _, i := range cases {
+		result, err := convertLinkHeader(i[0], "snake", ConversionPolicy{})
+		if err != nil {
+			t.Error(err)
+		}
+		if result != i[1] {
+			t.Error("'" + result + "' != '" + i[1] + "'")
+		}
+	}
+}
+
+func TestConvertResponseHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Meta", `{"nextCursor":"abc","totalCount":3}`)
+	header.Set("X-Pagination", `{"pageSize":20}`)
+	header.Set("X-Other", `{"keepMe":true}`)
+	header.Set("Location", "/items?itemId=3")
+	header.Set("Link", `</items?pageSize=20>; rel="next"`)
+
+	route := &RouteConfig{ConvertQuery: true, JSONHeaders: []string{"x-meta", "X-Pagination"}}
+	if err := convertResponseHeaders(header, route); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"X-Meta":       `{"next_cursor":"abc","total_count":3}`,
+		"X-Pagination": `{"page_size":20}`,
+		"X-Other":      `{"keepMe":true}`,
+		"Location":     "/items?item_id=3",
+		"Link":         `</items?page_size=20>; rel="next"`,
+	}
+	for name, value := range expected {
+		if header.Get(name) != value {
+			t.Error(name + ": '" + header.Get(name) + "' != '" + value + "'")
+		}
+	}
+}
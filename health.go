@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build information, set with -ldflags "-X main.version=1.2.3 -X main.commit=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// Paths of the probe endpoints, an empty path turns the endpoint off
+var (
+	healthPath  string
+	readyPath   string
+	versionPath string
+)
+
+// upstreamHealth is the outcome of the last health check of an upstream
+type upstreamHealth struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (h *upstreamHealth) set(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checked = time.Now()
+	h.err = err
+}
+
+// status returns when the upstream was last checked and why it's unhealthy, if it is
+func (h *upstreamHealth) status() (time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checked.IsZero() {
+		return h.checked, errors.New("not checked yet")
+	}
+	return h.checked, h.err
+}
+
+// check probes the upstream, with a GET of HealthPath when it has one or by
+// opening a connection otherwise
+func (u *UpstreamConfig) check(timeout time.Duration) error {
+	if u.HealthPath == "" {
+		host := u.target.Host
+		if u.target.Port() == "" {
+			port := "80"
+			if u.target.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(u.target.Hostname(), port)
+		}
+
+		conn, err := net.DialTimeout("tcp", host, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	target := *u.target
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(u.HealthPath, "/")
+
+	client := &http.Client{Transport: u.transport, Timeout: timeout}
+	res, err := client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("health check answered %s", res.Status)
+	}
+	return nil
+}
+
+// checkUpstreams checks every upstream now and then every interval
+func (c *ProxyConfig) checkUpstreams(interval, timeout time.Duration) {
+	for {
+		var wg sync.WaitGroup
+		for name, upstream := range c.Upstreams {
+			wg.Add(1)
+			go func(name string, upstream *UpstreamConfig) {
+				defer wg.Done()
+
+				err := upstream.check(timeout)
+				if _, previous := upstream.health.status(); (err == nil) != (previous == nil) {
+					if err != nil {
+						logger.Warn("upstream is unhealthy", "upstream", name, "error", err)
+					} else {
+						logger.Info("upstream is healthy", "upstream", name)
+					}
+				}
+				upstream.health.set(err)
+			}(name, upstream)
+		}
+		wg.Wait()
+
+		time.Sleep(interval)
+	}
+}
+
+// readinessChecks are what the proxy needs before it takes traffic, by name
+func readinessChecks() map[string]error {
+	checks := map[string]error{"config": nil, "jwks": nil, "serving": nil}
+	if isShuttingDown() {
+		checks["serving"] = errors.New("shutting down")
+	}
+
+	for name, upstream := range proxyConfig.Upstreams {
+		if upstream.target == nil {
+			checks["config"] = fmt.Errorf("upstream %s isn't prepared", name)
+		}
+		_, checks["upstream:"+name] = upstream.health.status()
+	}
+
+	if authClient == nil || authClient.keySet() == nil || len(authClient.keySet().Keys) == 0 {
+		checks["jwks"] = errors.New("no signing keys loaded")
+	}
+
+	return checks
+}
+
+// serveHealth answers liveness probes, the proxy is alive as long as it answers
+func serveHealth(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]string{"status": "ok"})
+}
+
+// serveReady answers readiness probes with 503 and the failing checks until everything is ok
+func serveReady(res http.ResponseWriter, req *http.Request) {
+	status, results := "ready", make(map[string]string)
+	for name, err := range readinessChecks() {
+		results[name] = "ok"
+		if err != nil {
+			status, results[name] = "not ready", err.Error()
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if status != "ready" {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(res).Encode(map[string]interface{}{"status": status, "checks": results})
+}
+
+func serveVersion(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]string{
+		"version":   version,
+		"commit":    commit,
+		"buildDate": buildDate,
+		"goVersion": runtime.Version(),
+	})
+}
+
+// handleProbes registers the probe endpoints and metrics on mux
+func handleProbes(mux *http.ServeMux) {
+	for _, endpoint := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{healthPath, serveHealth},
+		{readyPath, serveReady},
+		{versionPath, serveVersion},
+		{metricsPath, serveMetrics},
+	} {
+		if endpoint.path != "" {
+			mux.HandleFunc(endpoint.path, endpoint.handler)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	cases := []struct {
+		url        string
+		healthPath string
+		healthy    bool
+	}{
+		{upstream.URL, "", true},
+		{upstream.URL + "/api", "health", true},
+		{upstream.URL + "/api/", "/health", true},
+		{upstream.URL, "/status", false},
+		{"http://" + closed.Addr().String(), "", false},
+	}
+	for _, i := range cases {
+		u := testUpstream(t, i.url)
+		u.HealthPath = i.healthPath
+		if err := u.check(time.Second); (err == nil) != i.healthy {
+			t.Errorf("%s%s: expected healthy %v, got %v", i.url, i.healthPath, i.healthy, err)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	public, err := jwk.New(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous, previousClient := proxyConfig, authClient
+	defer func() { proxyConfig, authClient = previous, previousClient }()
+
+	upstream := &UpstreamConfig{URL: "http://127.0.0.1:1"}
+	if err := upstream.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	proxyConfig = &ProxyConfig{Upstreams: map[string]*UpstreamConfig{"default": upstream}}
+	authClient = &CognitoAppClient{WellKnownJWKs: &jwk.Set{}}
+
+	ready := func() (int, map[string]string) {
+		res := httptest.NewRecorder()
+		serveReady(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var body struct {
+			Status string
+			Checks map[string]string
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return res.Code, body.Checks
+	}
+
+	status, checks := ready()
+	if status != http.StatusServiceUnavailable || checks["jwks"] != "no signing keys loaded" || checks["upstream:default"] != "not checked yet" || checks["config"] != "ok" {
+		t.Errorf("unexpected readiness %d %v", status, checks)
+	}
+
+	authClient.WellKnownJWKs.Keys = []jwk.Key{public}
+	upstream.health.set(nil)
+	if status, checks := ready(); status != http.StatusOK {
+		t.Errorf("expected ready, got %d %v", status, checks)
+	}
+
+	upstream.health.set(errors.New("connection refused"))
+	if status, checks := ready(); status != http.StatusServiceUnavailable || checks["upstream:default"] == "ok" {
+		t.Errorf("expected an unhealthy upstream to fail readiness, got %d %v", status, checks)
+	}
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	previous := [...]string{healthPath, readyPath, versionPath, metricsPath}
+	defer func() {
+		healthPath, readyPath, versionPath, metricsPath = previous[0], previous[1], previous[2], previous[3]
+	}()
+	healthPath, readyPath, versionPath, metricsPath = "/-/live", "", "/version", "/metrics"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleRequest)
+	handleProbes(mux)
+
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/-/live", http.StatusOK, `"status":"ok"`},
+		{"/version", http.StatusOK, `"version":"dev"`},
+		{"/metrics", http.StatusOK, "goproxy_requests_total"},
+		// Turned off and moved paths fall through to the proxy, which wants a token
+		{"/readyz", http.StatusUnauthorized, ""},
+		{"/healthz", http.StatusUnauthorized, ""},
+	}
+	for _, i := range cases {
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, i.path, nil))
+		if res.Code != i.status || !strings.Contains(res.Body.String(), i.body) {
+			t.Errorf("%s: unexpected %d %s", i.path, res.Code, res.Body.String())
+		}
+	}
+}
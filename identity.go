@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// IdentityAssertionConfig makes the proxy send upstreams a short-lived JWT it
+// signs itself, instead of the user attributes as plain JSON
+type IdentityAssertionConfig struct {
+	// Algorithm is "HS256" with the shared secret in SecretFile, or "RS256" with
+	// the PEM private key in KeyFile
+	Algorithm  string `json:"algorithm"`
+	SecretFile string `json:"secretFile"`
+	KeyFile    string `json:"keyFile"`
+	// KeyID is sent as the kid header, RS256 keys default to their JWK thumbprint
+	KeyID    string `json:"keyId"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// TTL is how long an assertion is valid, as a Go duration. Defaults to 60s.
+	TTL string `json:"ttl"`
+	// JWKSPath is where the RS256 public key is published, unauthenticated.
+	// Defaults to /.well-known/jwks.json.
+	JWKSPath string `json:"jwksPath"`
+
+	method jwt.SigningMethod
+	key    interface{}
+	ttl    time.Duration
+	jwks   []byte
+}
+
+// prepare loads the signing key and builds the JWKS document
+func (c *IdentityAssertionConfig) prepare() error {
+	c.ttl = time.Minute
+	if c.TTL != "" {
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil {
+			return err
+		}
+		c.ttl = ttl
+	}
+
+	if c.JWKSPath == "" {
+		c.JWKSPath = "/.well-known/jwks.json"
+	}
+
+	switch c.Algorithm {
+	case "HS256":
+		secret, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return err
+		}
+
+		secret = bytes.TrimSpace(secret)
+		if len(secret) < 32 {
+			return errors.New("identity assertion secret must be at least 32 bytes")
+		}
+
+		c.method = jwt.SigningMethodHS256
+		c.key = secret
+	case "RS256":
+		pem, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return err
+		}
+
+		c.method = jwt.SigningMethodRS256
+		c.key = key
+
+		return c.publishKey(key.Public())
+	default:
+		return fmt.Errorf("unknown identity assertion algorithm: %s", c.Algorithm)
+	}
+
+	return nil
+}
+
+func (c *IdentityAssertionConfig) publishKey(public crypto.PublicKey) error {
+	key, err := jwk.New(public)
+	if err != nil {
+		return err
+	}
+
+	if c.KeyID == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return err
+		}
+		c.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+
+	key.Set(jwk.KeyIDKey, c.KeyID)
+	key.Set(jwk.AlgorithmKey, c.Algorithm)
+	key.Set(jwk.KeyUsageKey, "sig")
+
+	c.jwks, err = json.Marshal(jwk.Set{Keys: []jwk.Key{key}})
+	return err
+}
+
+// assert signs a JWT for user. The user's own token claims are carried over
+// with the proxy's issuer, audience and lifetime, and the attributes are added
+// under "user" in the same shape as the plain JSON header.
+func (c *IdentityAssertionConfig) assert(user User, now time.Time) (string, error) {
+	claims := jwt.MapClaims{}
+	if original, ok := user.claims.(jwt.MapClaims); ok {
+		for name, value := range original {
+			claims[name] = value
+		}
+	}
+
+	expires := now.Add(c.ttl)
+	if userExpires, ok := user.expiresAt(); ok && userExpires.Before(expires) {
+		expires = userExpires
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	if _, ok := claims["sub"]; !ok {
+		claims["sub"] = user.attributes.Username
+	}
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = expires.Unix()
+	claims["jti"] = base64.RawURLEncoding.EncodeToString(jti)
+	claims["user"] = user.attributes
+	delete(claims, "iss")
+	delete(claims, "aud")
+	if c.Issuer != "" {
+		claims["iss"] = c.Issuer
+	}
+	if c.Audience != "" {
+		claims["aud"] = c.Audience
+	}
+
+	token := jwt.NewWithClaims(c.method, claims)
+	if c.KeyID != "" {
+		token.Header["kid"] = c.KeyID
+	}
+
+	return token.SignedString(c.key)
+}
+
+// serveJWKS publishes the public key upstreams verify assertions with
+func (c *IdentityAssertionConfig) serveJWKS(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "public, max-age=300")
+	res.Write(c.jwks)
+}
+
+// IdentityHeaderConfig sends one identity value upstream in its own header.
+// The value comes from either a token claim or a user attribute.
+type IdentityHeaderConfig struct {
+	Header string `json:"header"`
+	Claim  string `json:"claim"`
+	// Attribute names a user attribute, in Cognito's form or camelCase, or
+	// "username" and "status" for those fields
+	Attribute string `json:"attribute"`
+	// Separator joins list claims such as cognito:groups, defaults to ","
+	Separator string `json:"separator"`
+}
+
+// Ways the Authorization header is forwarded upstream
+const (
+	ForwardJSON      = "json"
+	ForwardAssertion = "assertion"
+	ForwardNone      = "none"
+)
+
+func (c *IdentityHeaderConfig) validate() error {
+	if c.Header == "" {
+		return errors.New("identity header needs a header name")
+	}
+
+	if (c.Claim == "") == (c.Attribute == "") {
+		return fmt.Errorf("identity header %s needs exactly one of claim or attribute", c.Header)
+	}
+
+	return nil
+}
+
+// value returns the header value for user, false when the user doesn't have one
+func (c *IdentityHeaderConfig) value(user User) (string, bool) {
+	if c.Attribute != "" {
+		switch c.Attribute {
+		case "username":
+			return user.attributes.Username, user.attributes.Username != ""
+		case "status":
+			return user.attributes.Status, user.attributes.Status != ""
+		}
+
+		for _, field := range user.attributes.Attributes {
+			if field.Name == c.Attribute || field.Name == ToLowerCamel(c.Attribute) {
+				return field.Value, true
+			}
+		}
+		return "", false
+	}
+
+	claims, ok := user.claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+
+	separator := c.Separator
+	if separator == "" {
+		separator = ","
+	}
+
+	switch claim := claims[c.Claim].(type) {
+	case nil:
+		return "", false
+	case string:
+		return claim, true
+	case []interface{}:
+		values := make([]string, len(claim))
+		for i, value := range claim {
+			values[i] = fmt.Sprint(value)
+		}
+		return strings.Join(values, separator), true
+	case float64:
+		return strconv.FormatFloat(claim, 'f', -1, 64), true
+	default:
+		b, err := json.Marshal(claim)
+		return string(b), err == nil
+	}
+}
+
+// lineBreaks are replaced in identity header values, they'd end the header early
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// forwardIdentity replaces the caller's credentials with user's identity for the
+// upstream. Client supplied copies of the identity headers are always dropped.
+func forwardIdentity(req *http.Request, user User) error {
+	// Only identifiers are logged, the attributes can hold email addresses and other personal data
+	loggerFrom(req.Context()).Debug("authenticated user", "username", user.attributes.Username, "sub", user.subject())
+	formattedUserAttributes, err := json.Marshal(user.attributes)
+	if err != nil {
+		return err
+	}
+
+	for _, header := range proxyConfig.IdentityHeaders {
+		req.Header.Del(header.Header)
+		if value, ok := header.value(user); ok {
+			req.Header.Set(header.Header, lineBreaks.Replace(value))
+		}
+	}
+
+	switch proxyConfig.forwardAuthorization() {
+	case ForwardAssertion:
+		token, err := proxyConfig.IdentityAssertion.assert(user, time.Now())
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+	case ForwardNone:
+		req.Header.Del("Authorization")
+	default:
+		req.Header.Set("Authorization", string(formattedUserAttributes))
+	}
+
+	return nil
+}
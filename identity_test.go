@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+var testUser = User{
+	authenticated: true,
+	claims:        jwt.MapClaims{"sub": "1234-abcd", "username": "ada", "iss": "https://cognito", "exp": float64(time.Now().Add(time.Hour).Unix())},
+	attributes:    UserAttributes{Enabled: true, Username: "ada", Status: "CONFIRMED"},
+}
+
+func TestIdentityAssertionHS256(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "identity")
+	defer os.RemoveAll(dir)
+
+	secret := strings.Repeat("s", 32)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte(secret+"\n"), 0600)
+	config := &IdentityAssertionConfig{Algorithm: "HS256", SecretFile: filepath.Join(dir, "secret"), Issuer: "goproxy", Audience: "billing"}
+	if err := config.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	signed, err := config.assert(testUser, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			t.Error("unexpected signing method")
+		}
+		return []byte(secret), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	cases := [][]string{
+		{"sub", "1234-abcd"},
+		{"username", "ada"},
+		{"iss", "goproxy"},
+		{"aud", "billing"},
+	}
+	for _, i := range cases {
+		if value, _ := claims[i[0]].(string); value != i[1] {
+			t.Error("'" + value + "' != '" + i[1] + "'")
+		}
+	}
+	if int64(claims["exp"].(float64)) != now.Add(time.Minute).Unix() {
+		t.Error("expected the assertion to live for the default ttl")
+	}
+	if user, _ := claims["user"].(map[string]interface{}); user["username"] != "ada" {
+		t.Error("expected the user attributes in the assertion")
+	}
+}
+
+func TestIdentityAssertionRS256(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "identity")
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := writePEM(dir, "assertion.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+
+	config := &IdentityAssertionConfig{Algorithm: "RS256", KeyFile: keyFile, TTL: "5m"}
+	if err := config.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	config.serveJWKS(res, httptest.NewRequest(http.MethodGet, config.JWKSPath, nil))
+	keys, err := jwk.ParseBytes(res.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The assertion never outlives the token it was minted from
+	user := testUser
+	user.claims = jwt.MapClaims{"sub": "1234-abcd", "exp": float64(time.Now().Add(time.Minute).Unix())}
+	signed, err := config.assert(user, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Backends can verify it the same way the proxy verifies Cognito tokens
+	token, err := parseJWT(signed, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWT(token, ""); err != nil {
+		t.Error(err)
+	}
+	if token.Claims.(jwt.MapClaims)["exp"].(float64) != user.claims.(jwt.MapClaims)["exp"].(float64) {
+		t.Error("expected the assertion to expire with the user's token")
+	}
+}
+
+func TestForwardIdentity(t *testing.T) {
+	previous := proxyConfig
+	defer func() { proxyConfig = previous }()
+
+	proxyConfig = &ProxyConfig{}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := forwardIdentity(req, testUser); err != nil {
+		t.Fatal(err)
+	}
+	var attributes UserAttributes
+	if err := json.Unmarshal([]byte(req.Header.Get("Authorization")), &attributes); err != nil || attributes.Username != "ada" {
+		t.Error("expected the user attributes as JSON without an identity assertion")
+	}
+
+	dir, _ := ioutil.TempDir("", "identity")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte(strings.Repeat("s", 32)), 0600)
+	proxyConfig.IdentityAssertion = &IdentityAssertionConfig{Algorithm: "HS256", SecretFile: filepath.Join(dir, "secret")}
+	if err := proxyConfig.IdentityAssertion.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := forwardIdentity(req, testUser); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ey") {
+		t.Error("expected a signed assertion, got " + req.Header.Get("Authorization"))
+	}
+}
+
+func TestIdentityAssertionValidation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "identity")
+	defer os.RemoveAll(dir)
+	short := filepath.Join(dir, "short")
+	ioutil.WriteFile(short, []byte("secret"), 0600)
+
+	cases := []*IdentityAssertionConfig{
+		{Algorithm: "none"},
+		{Algorithm: "HS256", SecretFile: short},
+		{Algorithm: "HS256", SecretFile: "missing"},
+		{Algorithm: "RS256", KeyFile: short},
+		{Algorithm: "HS256", SecretFile: short, TTL: "soon"},
+	}
+	for _, i := range cases {
+		if err := i.prepare(); err == nil {
+			t.Errorf("expected %+v to be rejected", i)
+		}
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	previous := proxyConfig
+	defer func() { proxyConfig = previous }()
+
+	proxyConfig = &ProxyConfig{
+		IdentityHeaders: []IdentityHeaderConfig{
+			{Header: "X-User-Id", Claim: "sub"},
+			{Header: "X-User-Email", Attribute: "email"},
+			{Header: "X-User-Tenant", Attribute: "custom:tenant_id"},
+			{Header: "X-User-Groups", Claim: "cognito:groups"},
+			{Header: "X-User-Name", Attribute: "username"},
+			{Header: "X-Auth-Time", Claim: "auth_time"},
+			{Header: "X-User-Phone", Attribute: "phoneNumber"},
+		},
+		ForwardAuthorization: ForwardNone,
+	}
+
+	user := User{
+		authenticated: true,
+		claims: jwt.MapClaims{
+			"sub":            "1234-abcd",
+			"cognito:groups": []interface{}{"admin", "billing"},
+			"auth_time":      float64(1565000000),
+		},
+		attributes: UserAttributes{
+			Username: "ada",
+			Attributes: []UserAttributeField{
+				{Name: "email", Value: "ada@example.com"},
+				{Name: ToLowerCamel("custom:tenant_id"), Value: "acme\r\nX-Injected: 1"},
+			},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-User-Id", "spoofed")
+	req.Header.Set("X-User-Phone", "spoofed")
+	if err := forwardIdentity(req, user); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [][]string{
+		{"X-User-Id", "1234-abcd"},
+		{"X-User-Email", "ada@example.com"},
+		{"X-User-Tenant", "acme  X-Injected: 1"},
+		{"X-User-Groups", "admin,billing"},
+		{"X-User-Name", "ada"},
+		{"X-Auth-Time", "1565000000"},
+		{"X-User-Phone", ""},
+		{"Authorization", ""},
+	}
+	for _, i := range cases {
+		if value := req.Header.Get(i[0]); value != i[1] {
+			t.Error(i[0] + ": '" + value + "' != '" + i[1] + "'")
+		}
+	}
+}
+
+func TestLoadProxyConfigIdentityHeaders(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "identity")
+	defer os.RemoveAll(dir)
+
+	cases := []string{
+		`{"identityHeaders":[{"claim":"sub"}]}`,
+		`{"identityHeaders":[{"header":"X-User-Id"}]}`,
+		`{"identityHeaders":[{"header":"X-User-Id","claim":"sub","attribute":"email"}]}`,
+		`{"forwardAuthorization":"assertion"}`,
+		`{"forwardAuthorization":"cookie"}`,
+	}
+	for _, i := range cases {
+		path := filepath.Join(dir, "config.json")
+		ioutil.WriteFile(path, []byte(i), 0600)
+		if _, err := loadProxyConfig(path, &UpstreamConfig{URL: "http://backend"}); err == nil {
+			t.Error("expected " + i + " to be rejected")
+		}
+	}
+}
+
+func TestForwardIdentityLogsNoAttributes(t *testing.T) {
+	previous, previousLogger := proxyConfig, logger
+	l, out := testLogger(t, FormatJSON, LevelDebug)
+	proxyConfig, logger = &ProxyConfig{}, l
+	defer func() { proxyConfig, logger = previous, previousLogger }()
+
+	user := testUser
+	user.attributes.Attributes = []UserAttributeField{{Name: "email", Value: "ada@example.com"}}
+	if err := forwardIdentity(httptest.NewRequest(http.MethodGet, "/", nil), user); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"sub":"1234-abcd"`) || strings.Contains(out.String(), "ada@example.com") {
+		t.Error("expected only the user's identifiers to be logged: " + out.String())
+	}
+}
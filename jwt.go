@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/rsa"
 	"errors"
-	"log"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/lestrrat-go/jwx/jwk"
@@ -13,13 +12,13 @@ func parseJWT(t string, keys *jwk.Set) (*jwt.Token, error) {
 	token, err := jwt.Parse(t, func(token *jwt.Token) (interface{}, error) {
 		keys := keys.LookupKeyID(token.Header["kid"].(string))
 		if len(keys) == 0 {
-			log.Println("failed to look up JWKs")
+			logger.Warn("failed to look up JWKs", "kid", token.Header["kid"])
 			return nil, errors.New("could not find matching `kid` in well known tokens")
 		}
 		// Build the public RSA key
 		key, err := keys[0].Materialize()
 		if err != nil {
-			log.Printf("failed to create public key: %s", err)
+			logger.Error("failed to create public key", "error", err)
 			return nil, err
 		}
 		rsaPublicKey := key.(*rsa.PublicKey)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// keyCache is a bounded, concurrency safe LRU of converted object keys. Requests
+// and responses tend to repeat the same small set of field names, so most keys
+// are converted once and looked up afterwards.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[keyCacheKey]*list.Element
+	order   *list.List
+}
+
+type keyCacheKey struct {
+	style     string
+	roundTrip bool
+	key       string
+}
+
+type keyCacheEntry struct {
+	key   keyCacheKey
+	value string
+}
+
+// newKeyCache returns a cache holding at most size keys, a size of 0 disables caching
+func newKeyCache(size int) *keyCache {
+	return &keyCache{
+		size:    size,
+		entries: make(map[keyCacheKey]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+func (c *keyCache) get(k keyCacheKey) (string, bool) {
+	if c.size <= 0 {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[k]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*keyCacheEntry).value, true
+}
+
+func (c *keyCache) add(k keyCacheKey, value string) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[k]; ok {
+		element.Value.(*keyCacheEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[k] = c.order.PushFront(&keyCacheEntry{key: k, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*keyCacheEntry).key)
+	}
+}
+
+func (c *keyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
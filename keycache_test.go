@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKeyCacheEviction(t *testing.T) {
+	cache := newKeyCache(2)
+	a := keyCacheKey{style: "snake", key: "a"}
+	b := keyCacheKey{style: "snake", key: "b"}
+	c := keyCacheKey{style: "snake", key: "c"}
+
+	cache.add(a, "1")
+	cache.add(b, "2")
+	if _, ok := cache.get(a); !ok {
+		t.Error("expected a to be cached")
+	}
+
+	// b is now the least recently used key
+	cache.add(c, "3")
+	if _, ok := cache.get(b); ok {
+		t.Error("expected b to be evicted")
+	}
+	if value, ok := cache.get(a); !ok || value != "1" {
+		t.Error("expected a to survive eviction")
+	}
+	if cache.len() != 2 {
+		t.Error("cache grew past its size")
+	}
+}
+
+func TestKeyCacheDisabled(t *testing.T) {
+	cache := newKeyCache(0)
+	k := keyCacheKey{style: "camel", key: "a_b"}
+	cache.add(k, "aB")
+	if _, ok := cache.get(k); ok {
+		t.Fail()
+	}
+}
+
+func TestKeyCacheConcurrent(t *testing.T) {
+	cache := newKeyCache(64)
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := keyCacheKey{style: "snake", key: strconv.Itoa((i * n) % 100)}
+				cache.add(k, k.key)
+				if value, ok := cache.get(k); ok && value != k.key {
+					t.Error("'" + value + "' != '" + k.key + "'")
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	if cache.len() > 64 {
+		t.Error("cache grew past its size")
+	}
+}
@@ -2,25 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 )
 
 type incomingRequestLogItem struct {
-	Host          string                 `json:"host"`
-	Address       string                 `json:"address"`
-	Headers       map[string]string      `json:"headers"`
-	Method        string                 `json:"method"`
-	RequestURI    string                 `json:"requestURI"`
-	Proto         string                 `json:"proto"`
-	UserAgent     string                 `json:"userAgent"`
-	ContentLength int64                  `json:"contentLength"`
-	Query         url.Values             `json:"query"`
-	RequestBody   map[string]interface{} `json:"requestBody"`
+	Host          string            `json:"host"`
+	Address       string            `json:"address"`
+	Headers       map[string]string `json:"headers"`
+	Method        string            `json:"method"`
+	RequestURI    string            `json:"requestURI"`
+	Proto         string            `json:"proto"`
+	UserAgent     string            `json:"userAgent"`
+	ContentLength int64             `json:"contentLength"`
+	Query         url.Values        `json:"query"`
+	RequestBody   interface{}       `json:"requestBody"`
 }
 
 type outgoingRequestLogItem struct {
@@ -28,99 +28,179 @@ type outgoingRequestLogItem struct {
 	Headers       map[string]string `json:"headers"`
 	ResponseBody  interface{}       `json:"responseBody"`
 	ContentLength int64             `json:"contentLength"`
+	// RequestBody is only logged here when bodies are logged for errors only
+	RequestBody interface{} `json:"requestBody,omitempty"`
 }
 
 func transformHeaders(headers http.Header) map[string]string {
 	parsedHeaders := make(map[string]string, 10)
 	for name, values := range headers {
-		// Don't log out the token
+		// Don't log out the token, only that there was one
 		if name == "Authorization" {
 			parsedHeaders[name] = "true"
 			continue
 		}
+		if name == "Referer" {
+			parsedHeaders[name] = loggedReferer(values[0])
+			continue
+		}
+		if redaction.header(name) {
+			parsedHeaders[name] = redaction.value(values[0])
+			continue
+		}
 		parsedHeaders[name] = values[0]
 	}
 
 	return parsedHeaders
 }
 
-func readAndParseBody(b io.ReadCloser, t string) (io.ReadCloser, map[string]interface{}, error) {
+// readAndParseBody reads b, returning a reader replaying it and what is logged for the body
+func readAndParseBody(log *Logger, b io.ReadCloser, contentType string, t string) (io.ReadCloser, interface{}, error) {
 	body, err := ioutil.ReadAll(b)
 
 	if err != nil {
-		log.Println(err)
-		log.Println("unexpected error when parsing HTTP body")
+		log.Error("unexpected error when parsing HTTP body", "error", err)
 		return nil, nil, err
 	}
 
 	resetBody := ioutil.NopCloser(bytes.NewBuffer(body))
 
 	if !IsJSON(body) {
-		log.Println("response body is not JSON")
-		return resetBody, nil, err
+		log.Debug("body is not JSON", "body", t)
+		return resetBody, bodyLogging.summary(contentType, int64(len(body))), nil
 	}
 
-	var placeholder map[string]interface{}
-	err = json.Unmarshal(body, &placeholder)
-
+	value, err := bodyLogging.value(body)
 	if err != nil {
-		log.Println(err)
-		log.Printf("unable to parse JSON in HTTP body %s", t)
+		log.Debug("unable to parse JSON in HTTP body", "body", t, "error", err)
 		return resetBody, nil, err
 	}
 
-	return resetBody, placeholder, nil
+	return resetBody, value, nil
 }
 
-func stringifyAndLog(item interface{}) string {
+// stringifyAndLog logs item as the field key of an info record and returns its JSON
+func stringifyAndLog(log *Logger, msg string, key string, item interface{}) string {
 	jsoned, err := json.Marshal(item)
 
 	if err != nil {
-		log.Println(err)
-		log.Println("unable to JSON stringify log item")
+		log.Error("unable to JSON stringify log item", "error", err)
 		return ""
 	}
 
-	stringified := string(jsoned)
-	log.Println(stringified)
+	log.Info(msg, key, json.RawMessage(jsoned))
 
-	return stringified
+	return string(jsoned)
 }
 
 func logRequest(req *http.Request) string {
+	log := loggerFrom(req.Context())
 	item := incomingRequestLogItem{
 		Host:          req.Host,
 		Address:       req.RemoteAddr,
 		Headers:       transformHeaders(req.Header),
 		Method:        req.Method,
-		RequestURI:    req.RequestURI,
+		RequestURI:    loggedRequestURI(req),
 		Proto:         req.Proto,
 		UserAgent:     req.Header.Get("User-Agent"),
 		ContentLength: req.ContentLength,
-		Query:         req.URL.Query(),
+		Query:         redaction.query(req.URL.Query()),
 	}
 
-	if req.Method == "POST" || req.Method == "PUT" {
-		if resetBody, requestBody, err := readAndParseBody(req.Body, "request"); err == nil {
-			req.Body = resetBody
-			item.RequestBody = requestBody
-		}
+	body := loggedRequestBody(log, req)
+
+	// Without knowing the status yet, errors only logging holds on to the body until the response
+	if !bodyLogging.onlyErrors() {
+		item.RequestBody = body
+	} else if record := accessRecordFrom(req.Context()); record != nil {
+		record.requestBody = body
+		record.requestLogged = true
+	}
+
+	return stringifyAndLog(log, "incoming request", "request", item)
+}
+
+// loggedRequestBody returns what the logs show of req's body, nil when it isn't logged
+func loggedRequestBody(log *Logger, req *http.Request) interface{} {
+	contentType := req.Header.Get("Content-Type")
+	if (req.Method != "POST" && req.Method != "PUT") || !bodyLogging.request(req.Context(), req.URL.Path) || !bodyLogging.contentType(contentType) {
+		return nil
+	}
+
+	if !isBuffered(req.ContentLength) {
+		return bodyLogging.summary(contentType, req.ContentLength)
+	}
+
+	resetBody, body, err := readAndParseBody(log, req.Body, contentType, "request")
+	if err != nil {
+		return nil
 	}
+	req.Body = resetBody
+	return body
+}
 
-	return stringifyAndLog(item)
+// logRejectedRequest logs the request body errors only logging held back when
+// the proxy answers req with an error itself, as no upstream response logs it.
+// Requests rejected before they were logged have their body read here.
+func logRejectedRequest(req *http.Request, status int) {
+	record := accessRecordFrom(req.Context())
+	if record == nil || status < 400 || !bodyLogging.onlyErrors() {
+		return
+	}
+
+	log := loggerFrom(req.Context())
+	body := record.requestBody
+	if !record.requestLogged {
+		body = loggedRequestBody(log, req)
+		record.requestLogged = true
+	}
+	record.requestBody = nil
+
+	if body != nil {
+		log.Info("rejected request", "status", status, "requestBody", body)
+	}
 }
 
 func logResponse(res *http.Response) string {
+	log := logger
+	if res.Request != nil {
+		log = loggerFrom(res.Request.Context())
+	}
 	item := outgoingRequestLogItem{
 		StatusCode:    res.StatusCode,
 		Headers:       transformHeaders(res.Header),
 		ContentLength: res.ContentLength,
 	}
 
-	if resetBody, responseBody, err := readAndParseBody(res.Body, "response"); err == nil {
+	ctx, path := context.Background(), ""
+	if res.Request != nil {
+		ctx, path = res.Request.Context(), res.Request.URL.Path
+	}
+
+	if !bodyLogging.request(ctx, path) || (bodyLogging.onlyErrors() && res.StatusCode < 400) {
+		return stringifyAndLog(log, "upstream response", "response", item)
+	}
+
+	if record := accessRecordFrom(ctx); bodyLogging.onlyErrors() && record != nil {
+		item.RequestBody = record.requestBody
+		record.requestBody = nil
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if !bodyLogging.contentType(contentType) {
+		return stringifyAndLog(log, "upstream response", "response", item)
+	}
+
+	// Only JSON responses are held in memory, everything else streams to the client
+	if !isJSONContent(contentType) || isEncoded(res.Header) || !isBuffered(res.ContentLength) {
+		item.ResponseBody = bodyLogging.summary(contentType, res.ContentLength)
+		return stringifyAndLog(log, "upstream response", "response", item)
+	}
+
+	if resetBody, responseBody, err := readAndParseBody(log, res.Body, contentType, "response"); err == nil {
 		res.Body = resetBody
 		item.ResponseBody = responseBody
 	}
 
-	return stringifyAndLog(item)
+	return stringifyAndLog(log, "upstream response", "response", item)
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Level is the severity of a log record
+type Level int32
+
+// Log levels, from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %s", name)
+}
+
+// Log record formats
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Sink receives formatted log records, one per call
+type Sink interface {
+	Write(level Level, record []byte) error
+}
+
+// Logger writes structured records at or above its level to a sink. Fields
+// are passed as alternating keys and values after the message.
+type Logger struct {
+	core   *logCore
+	fields []interface{}
+}
+
+// logCore is shared by a logger and everything derived from it with With
+type logCore struct {
+	level  int32
+	format string
+
+	mu   sync.Mutex
+	sink Sink
+}
+
+var logger = &Logger{core: &logCore{level: int32(LevelInfo), format: FormatJSON, sink: writerSink{os.Stdout}}}
+
+func newLogger(sink Sink, format string, level Level) (*Logger, error) {
+	if format != FormatJSON && format != FormatLogfmt {
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+
+	return &Logger{core: &logCore{level: int32(level), format: format, sink: sink}}, nil
+}
+
+// With returns a logger adding fields to every record. It shares the level and sink.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	return &Logger{core: l.core, fields: append(append([]interface{}{}, l.fields...), fields...)}
+}
+
+// SetLevel changes the level of a running logger
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.core.level, int32(level))
+}
+
+// Level returns the current level
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.core.level))
+}
+
+func (l *Logger) enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// Debug logs msg and fields at debug level
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.log(LevelDebug, msg, fields)
+}
+
+// Info logs msg and fields at info level
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.log(LevelInfo, msg, fields)
+}
+
+// Warn logs msg and fields at warn level
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.log(LevelWarn, msg, fields)
+}
+
+// Error logs msg and fields at error level
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	all := append([]interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}, l.fields...)
+	all = append(all, fields...)
+	if len(all)%2 != 0 {
+		all = append(all[:len(all)-1], "!BADKEY", all[len(all)-1])
+	}
+
+	var record bytes.Buffer
+	if l.core.format == FormatLogfmt {
+		writeLogfmt(&record, all)
+	} else {
+		writeJSONRecord(&record, all)
+	}
+	record.WriteByte('\n')
+
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	if err := l.core.sink.Write(level, record.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to write log record: %s\n", err)
+	}
+}
+
+// fieldValue turns values that JSON would mangle, like errors and durations, into
+// text. Values with their own JSON, like json.RawMessage and time.Time, keep it
+// even when they're also Stringers.
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case json.Marshaler:
+		b, err := v.MarshalJSON()
+		if err != nil {
+			break
+		}
+		var s string
+		if json.Unmarshal(b, &s) == nil {
+			return s
+		}
+		return json.RawMessage(b)
+	}
+
+	if v, ok := value.(fmt.Stringer); ok {
+		return v.String()
+	}
+	return value
+}
+
+func writeJSONRecord(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeJSONString(b, fmt.Sprint(fields[i]))
+		b.WriteByte(':')
+
+		value, err := json.Marshal(fieldValue(fields[i+1]))
+		if err != nil {
+			writeJSONString(b, fmt.Sprint(fields[i+1]))
+			continue
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
+
+func writeLogfmt(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '=' || r == '"' {
+				return '_'
+			}
+			return r
+		}, fmt.Sprint(fields[i])))
+		b.WriteByte('=')
+
+		var value string
+		switch v := fieldValue(fields[i+1]).(type) {
+		case string:
+			value = v
+		case nil:
+			value = ""
+		case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+			value = fmt.Sprint(v)
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				encoded = []byte(fmt.Sprint(v))
+			}
+			value = string(encoded)
+		}
+
+		if value == "" || strings.IndexFunc(value, func(r rune) bool {
+			return r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError
+		}) >= 0 {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+}
+
+type loggerContextKey struct{}
+
+// withLogger returns ctx carrying l, for request scoped fields like the request ID
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// loggerFrom returns the logger carried by ctx, or the global one
+func loggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// writerSink writes records to any io.Writer, such as stdout or a rotatingFile
+type writerSink struct {
+	io.Writer
+}
+
+func (s writerSink) Write(level Level, record []byte) error {
+	_, err := s.Writer.Write(record)
+	return err
+}
+
+// syslogSink sends records to syslog with a priority matching their level
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func (s syslogSink) Write(level Level, record []byte) error {
+	message := string(bytes.TrimRight(record, "\n"))
+	switch level {
+	case LevelDebug:
+		return s.writer.Debug(message)
+	case LevelInfo:
+		return s.writer.Info(message)
+	case LevelWarn:
+		return s.writer.Warning(message)
+	default:
+		return s.writer.Err(message)
+	}
+}
+
+// rotatingFile appends to a file, moving it to name.1 (and older copies to
+// name.2 and so on) once it grows past maxSize. At most maxBackups are kept.
+type rotatingFile struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(name string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.name), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(f.name+"."+strconv.Itoa(i), f.name+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(f.name, f.name+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.name); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// openLogSink opens the sink described by target: "stdout", "stderr",
+// "file:///path/to/file", "syslog" for the local daemon, or
+// "syslog://host:514" (UDP) and "syslog+tcp://host:601" for a remote one
+func openLogSink(target string, maxSize int64, maxBackups int) (Sink, error) {
+	switch target {
+	case "", "stdout":
+		return writerSink{os.Stdout}, nil
+	case "stderr":
+		return writerSink{os.Stderr}, nil
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "goproxy")
+		if err != nil {
+			return nil, err
+		}
+		return syslogSink{writer}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("log file sink needs a path: %s", target)
+		}
+
+		file, err := openRotatingFile(u.Path, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		return writerSink{file}, nil
+	case "syslog", "syslog+udp", "syslog+tcp":
+		network := "udp"
+		if u.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+
+		writer, err := syslog.Dial(network, u.Host, syslog.LOG_INFO|syslog.LOG_DAEMON, "goproxy")
+		if err != nil {
+			return nil, err
+		}
+		return syslogSink{writer}, nil
+	}
+
+	return nil, fmt.Errorf("unknown log sink: %s", target)
+}
+
+// stdLogWriter sends lines from the standard library's log package, which
+// net/http and httputil use, through the logger at error level
+type stdLogWriter struct {
+	logger *Logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.Error(string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
+
+// watchLevelSignals switches to debug logging on SIGUSR1 and back to the
+// configured level on SIGUSR2. With a levelFile, SIGHUP makes the level in it,
+// such as warn, the configured level.
+func (l *Logger) watchLevelSignals(configured Level, levelFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	if levelFile != "" {
+		signal.Notify(signals, syscall.SIGHUP)
+	}
+
+	for s := range signals {
+		configured = l.levelSignal(s, configured, levelFile)
+	}
+}
+
+// levelSignal applies the level change s asks for, returning the configured level after it
+func (l *Logger) levelSignal(s os.Signal, configured Level, levelFile string) Level {
+	switch s {
+	case syscall.SIGUSR1:
+		l.SetLevel(LevelDebug)
+	case syscall.SIGUSR2:
+		l.SetLevel(configured)
+	case syscall.SIGHUP:
+		level, err := readLevelFile(levelFile)
+		if err != nil {
+			l.Error("unable to reload log level", "file", levelFile, "error", err)
+			return configured
+		}
+		configured = level
+		l.SetLevel(level)
+	}
+
+	l.Info("log level changed", "level", l.Level())
+	return configured
+}
+
+// readLevelFile reads a level name from path, ignoring surrounding whitespace
+func readLevelFile(path string) (Level, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return LevelInfo, err
+	}
+	return parseLevel(strings.TrimSpace(string(b)))
+}
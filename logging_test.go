@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testLogger(t *testing.T, format string, level Level) (*Logger, *bytes.Buffer) {
+	var out bytes.Buffer
+	l, err := newLogger(writerSink{&out}, format, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, &out
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, out := testLogger(t, FormatJSON, LevelInfo)
+	l.Info("request complete", "status", 200, "elapsed", 1500*time.Microsecond, "error", errors.New("boom"), "user", UserAttributes{Username: "ada"},
+		"request", json.RawMessage(`{"host":"example.com"}`))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [][]string{
+		{"level", "info"},
+		{"msg", "request complete"},
+		{"elapsed", "1.5ms"},
+		{"error", "boom"},
+	}
+	for _, i := range cases {
+		if value, _ := record[i[0]].(string); value != i[1] {
+			t.Error("'" + value + "' != '" + i[1] + "'")
+		}
+	}
+	if record["status"] != float64(200) {
+		t.Error("expected numbers to stay numbers")
+	}
+	if user, _ := record["user"].(map[string]interface{}); user["username"] != "ada" {
+		t.Error("expected structs to be nested objects")
+	}
+	if request, _ := record["request"].(map[string]interface{}); request["host"] != "example.com" {
+		t.Errorf("expected raw JSON to be a nested object, got %v", record["request"])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	cases := []struct {
+		fields []interface{}
+		out    string
+	}{
+		{[]interface{}{"status", 200}, "status=200"},
+		{[]interface{}{"path", "/users"}, "path=/users"},
+		{[]interface{}{"error", errors.New("no such host")}, `error="no such host"`},
+		{[]interface{}{"body", `{"a":1}`}, `body="{\"a\":1}"`},
+		{[]interface{}{"empty", ""}, `empty=""`},
+		{[]interface{}{"query", map[string]int{"page": 2}}, `query="{\"page\":2}"`},
+		{[]interface{}{"odd key", true}, "odd_key=true"},
+		{[]interface{}{"dangling"}, "!BADKEY=dangling"},
+	}
+	for _, i := range cases {
+		l, out := testLogger(t, FormatLogfmt, LevelInfo)
+		l.Info("done", i.fields...)
+
+		line := strings.TrimSuffix(out.String(), "\n")
+		if !strings.Contains(line, " level=info msg=done ") || !strings.HasSuffix(line, " "+i.out) {
+			t.Error("'" + line + "' doesn't end with '" + i.out + "'")
+		}
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	l, out := testLogger(t, FormatJSON, LevelWarn)
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+	if lines := strings.Count(out.String(), "\n"); lines != 2 {
+		t.Errorf("expected 2 records at warn, got %d", lines)
+	}
+
+	out.Reset()
+	l.SetLevel(LevelDebug)
+	l.Debug("debug")
+	if !strings.Contains(out.String(), `"level":"debug"`) {
+		t.Error("expected debug records after changing the level")
+	}
+
+	cases := map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warn": LevelWarn, "error": LevelError}
+	for name, level := range cases {
+		if parsed, err := parseLevel(name); err != nil || parsed != level {
+			t.Error("unable to parse " + name)
+		}
+	}
+	if _, err := parseLevel("verbose"); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+
+	dir, _ := ioutil.TempDir("", "level")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "level")
+	ioutil.WriteFile(file, []byte("error\n"), 0644)
+	signals := []struct {
+		signal     os.Signal
+		level      Level
+		configured Level
+	}{
+		{syscall.SIGUSR1, LevelDebug, LevelInfo},
+		{syscall.SIGHUP, LevelError, LevelError},
+		{syscall.SIGUSR1, LevelDebug, LevelError},
+		// Back to the level from the file, not the one the logger started with
+		{syscall.SIGUSR2, LevelError, LevelError},
+	}
+	configured := LevelInfo
+	for _, i := range signals {
+		configured = l.levelSignal(i.signal, configured, file)
+		if l.Level() != i.level || configured != i.configured {
+			t.Errorf("%s: expected %s configured %s, got %s configured %s", i.signal, i.level, i.configured, l.Level(), configured)
+		}
+	}
+
+	ioutil.WriteFile(file, []byte("verbose"), 0644)
+	if configured = l.levelSignal(syscall.SIGHUP, configured, file); configured != LevelError || l.Level() != LevelError {
+		t.Error("expected an unreadable level file to leave the level alone")
+	}
+	if _, err := newLogger(writerSink{out}, "xml", LevelInfo); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
+
+func TestStdLogWriter(t *testing.T) {
+	l, out := testLogger(t, FormatJSON, LevelInfo)
+	std := log.New(stdLogWriter{l}, "", 0)
+	std.Println("http: proxy error: dial tcp: connection refused")
+
+	if !strings.Contains(out.String(), `"level":"error","msg":"http: proxy error: dial tcp: connection refused"}`) {
+		t.Error("unexpected record " + out.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "nested", "proxy.log")
+	f, err := openRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := [][]string{
+		{name, "fourth\n"},
+		{name + ".1", "third\n"},
+		{name + ".2", "second\n"},
+	}
+	for _, i := range cases {
+		b, _ := ioutil.ReadFile(i[0])
+		if string(b) != i[1] {
+			t.Error("'" + string(b) + "' != '" + i[1] + "'")
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only 2 backups to be kept")
+	}
+}
+
+func TestOpenLogSink(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(dir)
+
+	for _, target := range []string{"", "stdout", "stderr", "file://" + filepath.Join(dir, "proxy.log")} {
+		if _, err := openLogSink(target, 0, 0); err != nil {
+			t.Error(target + ": " + err.Error())
+		}
+	}
+
+	for _, target := range []string{"kafka://broker:9092", "file://", "syslog+tcp://127.0.0.1:1"} {
+		if _, err := openLogSink(target, 0, 0); err == nil {
+			t.Error("expected " + target + " to be rejected")
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,100 +19,360 @@ var poolID string
 var clientID string
 var region string
 var authClient *CognitoAppClient
+var metricsPath string // served without authentication, on the main port unless ADMIN_PORT is set
+var adminPort string
+var healthInterval time.Duration
+var healthTimeout time.Duration
+var shutdownDelay time.Duration
+var shutdownGracePeriod time.Duration
+
+func proxyErrorResponse(status int, message string, res http.ResponseWriter, req *http.Request) {
+	if record := accessRecordFrom(req.Context()); record != nil {
+		record.err = message
+	}
+	logRejectedRequest(req, status)
+
+	if isGRPCRequest(req) {
+		grpcErrorResponse(status, message, res)
+		return
+	}
 
-func proxyErrorResponse(status int, message string, res http.ResponseWriter, start time.Time) {
 	res.Header().Set("Content-Type", "application/json")
 	res.Header().Set("Access-Control-Allow-Origin", "*")
 	res.WriteHeader(status)
 	json.NewEncoder(res).Encode(map[string]interface{}{"error": message, "data": nil})
-	log.Printf("elapsed time: %s", time.Since(start))
 }
 
 func handleRequest(res http.ResponseWriter, req *http.Request) {
-	start := time.Now()
-	valid, err := validJSONRequestBody(req)
+	record := newAccessRecord(req)
+	ctx, span := startSpan(extractTraceContext(record.context(req.Context()), req.Header), "HTTP "+req.Method, SpanKindServer,
+		"http.method", req.Method, "http.target", req.URL.Path, "http.request_id", record.id)
+	if span != nil {
+		ctx = withLogger(ctx, loggerFrom(ctx).With("traceId", span.traceID()))
+	}
+	req = req.WithContext(ctx)
+	requestLogger := loggerFrom(ctx)
 
-	if err != nil {
-		proxyErrorResponse(http.StatusInternalServerError, "Internal server error", res, start)
+	requestsInFlight.add(1)
+	defer requestsInFlight.add(-1)
+
+	writer := &accessLogResponseWriter{ResponseWriter: res}
+	defer record.log(req.Context(), writer)
+	defer endServerSpan(span, record, writer)
+	res = writer
+
+	req.Header.Set(requestIDHeader, record.id)
+	res.Header().Set(requestIDHeader, record.id)
+
+	if isWebSocketUpgrade(req) {
+		if protocol := takeWebSocketToken(req); protocol != "" {
+			req = req.WithContext(withWebSocketProtocol(req.Context(), protocol))
+		}
+	}
+	record.requestURI = loggedRequestURI(req)
+
+	route := proxyConfig.route(req.URL.Path)
+	record.route = route.Prefix
+
+	if message, ok := maintenance.message(route.Prefix); ok {
+		proxyErrorResponse(http.StatusServiceUnavailable, message, res, req)
 		return
 	}
 
-	if !valid {
-		proxyErrorResponse(http.StatusBadRequest, "Body must be valid JSON", res, start)
+	if err := convertRequestQuery(req, route); err != nil {
+		if collision, ok := err.(*KeyCollisionError); ok {
+			requestLogger.Info("query string keys collide", "error", err)
+			proxyErrorResponse(http.StatusBadRequest, "Query string keys "+collision.keyList()+" collide after conversion", res, req)
+			return
+		}
+
+		requestLogger.Info("malformed query string", "error", err)
+		proxyErrorResponse(http.StatusBadRequest, "Malformed query string", res, req)
 		return
 	}
 
-	logRequest(req)
+	_, validation := startSpan(req.Context(), "validate request body", SpanKindInternal)
+	valid, err := validJSONRequestBody(req, route)
+	validation.SetError(err)
+	validation.End()
+
+	if err != nil {
+		if collision, ok := err.(*KeyCollisionError); ok {
+			proxyErrorResponse(http.StatusBadRequest, "Body keys "+collision.keyList()+" collide after conversion", res, req)
+			return
+		}
 
-	authorizationHeader := req.Header.Get("Authorization")
-	if authorizationHeader == "" {
-		log.Println("no authorization header present in request")
-		proxyErrorResponse(http.StatusUnauthorized, "Unauthorized", res, start)
+		proxyErrorResponse(http.StatusInternalServerError, "Internal server error", res, req)
 		return
 	}
 
-	bearerToken := strings.Split(authorizationHeader, " ")
-	if len(bearerToken) != 2 {
-		log.Println("malformed authorization header present in request")
-		proxyErrorResponse(http.StatusUnauthorized, "Unauthorized", res, start)
+	if !valid {
+		proxyErrorResponse(http.StatusBadRequest, "Body must be valid JSON or form data", res, req)
 		return
 	}
 
-	user, err := authClient.authenticate(bearerToken[1])
+	logRequest(req)
+
+	authStart := time.Now()
+	user, err := authenticateRequest(req, route)
+	record.authLatency = time.Since(authStart)
+	authTotal.inc(authResult(err))
 	if err != nil {
-		log.Println(err)
-		proxyErrorResponse(http.StatusUnauthorized, "Unauthorized", res, start)
+		requestLogger.Info("authentication failed", "error", err)
+		proxyErrorResponse(http.StatusUnauthorized, "Unauthorized", res, req)
 		return
 	}
 
-	if user.authenticated == false {
-		log.Println("invalid token")
-		proxyErrorResponse(http.StatusUnauthorized, "Unauthorized", res, start)
-		return
+	record.sub = user.subject()
+
+	if expires, ok := user.expiresAt(); ok && isWebSocketUpgrade(req) {
+		res = &expiringResponseWriter{ResponseWriter: res, expires: expires}
 	}
 
-	formattedUserAttributes, err := json.Marshal(user.attributes)
-	log.Println(string(formattedUserAttributes))
-	if err != nil {
-		log.Println(err)
-		proxyErrorResponse(http.StatusInternalServerError, "Internal server error", res, start)
+	if err := forwardIdentity(req, user); err != nil {
+		requestLogger.Error("unable to forward identity", "error", err)
+		proxyErrorResponse(http.StatusInternalServerError, "Internal server error", res, req)
 		return
 	}
 
-	req.Header.Set("Authorization", string(formattedUserAttributes))
-	serveReverseProxy(endpoint, res, req, start)
+	record.upstream = route.Upstream
+	if record.upstream == "" {
+		record.upstream = "default"
+	}
+
+	serveReverseProxy(proxyConfig.upstream(route), route, res, req)
 }
 
-func serveReverseProxy(target string, res http.ResponseWriter, req *http.Request, start time.Time) {
-	url, _ := url.Parse(target)
+func serveReverseProxy(upstream *UpstreamConfig, route *RouteConfig, res http.ResponseWriter, req *http.Request) {
+	url := upstream.target
 
 	proxy := httputil.NewSingleHostReverseProxy(url)
-	proxy.Transport = &transport{http.DefaultTransport}
+	proxy.Transport = &transport{RoundTripper: upstream.transport, route: route}
+	proxy.ModifyResponse = echoWebSocketProtocol
+	proxy.ErrorHandler = func(res http.ResponseWriter, req *http.Request, err error) {
+		loggerFrom(req.Context()).Error("upstream request failed", "upstream", upstream.URL, "error", err)
+		proxyErrorResponse(http.StatusBadGateway, "Bad gateway", res, req)
+	}
 
 	req.URL.Host = url.Host
 	req.URL.Scheme = url.Scheme
 	req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 	req.Host = url.Host
 
-	proxy.ServeHTTP(res, req)
-	log.Printf("elapsed time: %s", time.Since(start))
+	proxy.ServeHTTP(&flushingResponseWriter{ResponseWriter: res}, req)
 }
 
 func init() {
+	level, err := parseLevel(getEnvDefault("LOG_LEVEL", "info"))
+	if err != nil {
+		panic(err)
+	}
+
+	// The level file, when there is one, overrides LOG_LEVEL and is read again on SIGHUP
+	levelFile := getEnvDefault("LOG_LEVEL_FILE", "")
+	if levelFile != "" {
+		level, err = readLevelFile(levelFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	maxLogSize, err := strconv.ParseInt(getEnvDefault("LOG_FILE_MAX_SIZE", "104857600"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	maxLogBackups, err := strconv.Atoi(getEnvDefault("LOG_FILE_MAX_BACKUPS", "5"))
+	if err != nil {
+		panic(err)
+	}
+
+	logSink, logFormat := getEnvDefault("LOG_SINK", "stdout"), getEnvDefault("LOG_FORMAT", "json")
+	sink, err := openLogSink(logSink, maxLogSize, maxLogBackups)
+	if err != nil {
+		panic(err)
+	}
+
+	logger, err = newLogger(sink, logFormat, level)
+	if err != nil {
+		panic(err)
+	}
+
+	accessLogSink, accessLogFormat, accessLogTemplate := getEnvDefault("ACCESS_LOG_SINK", "stdout"), getEnvDefault("ACCESS_LOG_FORMAT", "json"), getEnvDefault("ACCESS_LOG_TEMPLATE", "")
+	accessSink, err := openLogSink(accessLogSink, maxLogSize, maxLogBackups)
+	if err != nil {
+		panic(err)
+	}
+
+	accessLog, err = newAccessLogger(accessSink, accessLogFormat, accessLogTemplate)
+	if err != nil {
+		panic(err)
+	}
+
+	// net/http and httputil report through the standard logger
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logger})
+	go logger.watchLevelSignals(level, levelFile)
+
+	tracesEndpoint := getEnvDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if base := getEnvDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""); tracesEndpoint == "" && base != "" {
+		tracesEndpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	serviceName := getEnvDefault("OTEL_SERVICE_NAME", "goproxy")
+	tracesHeaders := map[string]string{}
+	if tracesEndpoint != "" {
+		sampleRatio, err := strconv.ParseFloat(getEnvDefault("OTEL_TRACES_SAMPLER_ARG", "1"), 64)
+		if err != nil {
+			panic(err)
+		}
+
+		headers, err := parseOTLPHeaders(getEnvDefault("OTEL_EXPORTER_OTLP_HEADERS", ""))
+		if err != nil {
+			panic(err)
+		}
+
+		for name := range headers {
+			tracesHeaders[name] = redactedValue
+		}
+
+		exporter := newOTLPExporter(tracesEndpoint, headers, serviceName)
+		tracing = &tracer{exporter: exporter, sampleRatio: sampleRatio}
+	}
+
 	port = getEnv("PORT")
 	endpoint = getEnv("URL")
 	poolID = getEnv("POOL_ID")
 	clientID = getEnv("CLIENT_ID")
 	region = getEnv("AWS_REGION")
 
-	config := &CognitoAppClientConfig{
+	upstreamProtocol, configFile := getEnvDefault("UPSTREAM_PROTOCOL", ""), getEnvDefault("CONFIG_FILE", "")
+	defaultUpstream := &UpstreamConfig{URL: endpoint, Protocol: upstreamProtocol}
+	config, err := loadProxyConfig(configFile, defaultUpstream)
+	if err != nil {
+		panic(err)
+	}
+
+	proxyConfig = config
+	redaction = config.redaction
+	bodyLogging = config.bodyLogging
+
+	collisionPolicy := getEnvDefault("KEY_COLLISION_POLICY", "original")
+	collisions, err := parseCollisionPolicy(collisionPolicy)
+	if err != nil {
+		panic(err)
+	}
+
+	roundTrip, err := strconv.ParseBool(getEnvDefault("KEY_ROUND_TRIP", "false"))
+	if err != nil {
+		panic(err)
+	}
+
+	conversionPolicy = ConversionPolicy{Collisions: collisions, RoundTrip: roundTrip}
+
+	cacheSize, err := strconv.Atoi(getEnvDefault("KEY_CACHE_SIZE", "4096"))
+	if err != nil {
+		panic(err)
+	}
+
+	convertedKeys = newKeyCache(cacheSize)
+
+	metricsPath = getEnvDefault("METRICS_PATH", "/metrics")
+	healthPath = getEnvDefault("HEALTH_PATH", "/healthz")
+	readyPath = getEnvDefault("READY_PATH", "/readyz")
+	versionPath = getEnvDefault("VERSION_PATH", "/version")
+	adminPort = getEnvDefault("ADMIN_PORT", "")
+	adminToken = getEnvDefault("ADMIN_TOKEN", "")
+	if adminToken != "" && adminPort == "" {
+		panic("ADMIN_TOKEN needs ADMIN_PORT, the admin API is only served on its own port")
+	}
+
+	userCacheTTL, err := time.ParseDuration(getEnvDefault("USER_CACHE_TTL", "0s"))
+	if err != nil {
+		panic(err)
+	}
+
+	userCacheSize, err := strconv.Atoi(getEnvDefault("USER_CACHE_SIZE", "10000"))
+	if err != nil {
+		panic(err)
+	}
+
+	userAttributes = newUserCache(userCacheTTL, userCacheSize)
+
+	healthInterval, err = time.ParseDuration(getEnvDefault("UPSTREAM_HEALTH_INTERVAL", "10s"))
+	if err != nil {
+		panic(err)
+	}
+
+	healthTimeout, err = time.ParseDuration(getEnvDefault("UPSTREAM_HEALTH_TIMEOUT", "2s"))
+	if err != nil {
+		panic(err)
+	}
+
+	shutdownDelay, err = time.ParseDuration(getEnvDefault("SHUTDOWN_DELAY", "0s"))
+	if err != nil {
+		panic(err)
+	}
+
+	shutdownGracePeriod, err = time.ParseDuration(getEnvDefault("SHUTDOWN_GRACE_PERIOD", "30s"))
+	if err != nil {
+		panic(err)
+	}
+
+	maxBufferedBody, err = strconv.ParseInt(getEnvDefault("MAX_BUFFERED_BODY", "10485760"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	effective = effectiveSettings{
+		Port:                   port,
+		URL:                    redactedURL(endpoint),
+		UpstreamProtocol:       upstreamProtocol,
+		Region:                 region,
+		PoolID:                 poolID,
+		ClientID:               clientID,
+		ConfigFile:             configFile,
+		LogLevel:               level.String(),
+		LogLevelFile:           levelFile,
+		LogFormat:              logFormat,
+		LogSink:                redactedURL(logSink),
+		LogFileMaxSize:         maxLogSize,
+		LogFileMaxBackups:      maxLogBackups,
+		AccessLogSink:          redactedURL(accessLogSink),
+		AccessLogFormat:        accessLogFormat,
+		AccessLogTemplate:      accessLogTemplate,
+		TracesEndpoint:         redactedURL(tracesEndpoint),
+		TracesSampleRate:       tracing.sampleRatio,
+		TracesHeaders:          tracesHeaders,
+		ServiceName:            serviceName,
+		KeyCollisionPolicy:     collisionPolicy,
+		KeyRoundTrip:           roundTrip,
+		KeyCacheSize:           cacheSize,
+		MaxBufferedBody:        maxBufferedBody,
+		MetricsPath:            metricsPath,
+		HealthPath:             healthPath,
+		ReadyPath:              readyPath,
+		VersionPath:            versionPath,
+		AdminPort:              adminPort,
+		AdminToken:             adminToken != "",
+		UserCacheTTL:           userCacheTTL.String(),
+		UserCacheSize:          userCacheSize,
+		UpstreamHealthInterval: healthInterval.String(),
+		UpstreamHealthTimeout:  healthTimeout.String(),
+		ShutdownDelay:          shutdownDelay.String(),
+		ShutdownGracePeriod:    shutdownGracePeriod.String(),
+	}
+	effective.withBodyLogging(bodyLogging)
+	effective.withTLSFiles(config)
+
+	cognitoConfig := &CognitoAppClientConfig{
 		Region:   region,
 		PoolID:   poolID,
 		ClientID: clientID,
 	}
 
-	log.Println("initializing cognito client")
-	client, err := NewCognitoAppClient(config)
+	logger.Info("initializing cognito client")
+	client, err := NewCognitoAppClient(cognitoConfig)
 
 	if err != nil {
 		panic(err)
@@ -121,7 +384,77 @@ func init() {
 func main() {
 	final := http.HandlerFunc(handleRequest)
 	http.Handle("/", Gzip(final))
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if assertion := proxyConfig.IdentityAssertion; assertion != nil && assertion.jwks != nil {
+		http.HandleFunc(assertion.JWKSPath, assertion.serveJWKS)
+	}
+
+	// Probes and metrics go on their own port when there is one, out of the way of
+	// upstream routes. Neither asks for credentials, so without ADMIN_PORT anyone
+	// reaching the proxy can read the metrics.
+	var admin *http.Server
+	if adminPort == "" {
+		handleProbes(http.DefaultServeMux)
+		if metricsPath != "" {
+			logger.Warn("metrics are served without authentication on the main port, set ADMIN_PORT to move them or an empty METRICS_PATH to turn them off", "path", metricsPath)
+		}
+	} else {
+		mux := http.NewServeMux()
+		handleProbes(mux)
+		if adminToken != "" {
+			handleAdmin(mux, adminToken)
+		}
+		admin = &http.Server{Addr: ":" + adminPort, Handler: mux}
+	}
+
+	go proxyConfig.checkUpstreams(healthInterval, healthTimeout)
+
+	server := &http.Server{Addr: ":" + port}
+	servers := []*http.Server{server}
+	listen := server.ListenAndServe
+
+	if proxyConfig.TLS != nil {
+		tlsConfig, err := proxyConfig.TLS.serverConfig()
+		if err != nil {
+			panic(err)
+		}
+		server.TLSConfig = tlsConfig
+
+		// The certificates come from tlsConfig, so no files are passed here
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+
+		if redirectPort := proxyConfig.TLS.RedirectPort; redirectPort != "" {
+			servers = append(servers, &http.Server{Addr: ":" + redirectPort, Handler: redirectToHTTPS(port)})
+		}
+	}
+
+	// Accept cleartext HTTP/2 as well, gRPC clients won't speak anything else. This
+	// comes after the TLS config, which it adds HTTP/2 to.
+	if err := configureHTTP2(server, http.DefaultServeMux); err != nil {
 		panic(err)
 	}
+
+	errs := make(chan error, len(servers)+1)
+	go func() { errs <- listen() }()
+	for _, extra := range servers[1:] {
+		go func(extra *http.Server) { errs <- extra.ListenAndServe() }(extra)
+	}
+	if admin != nil {
+		go func() { errs <- admin.ListenAndServe() }()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errs:
+		panic(err)
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig.String(), "gracePeriod", shutdownGracePeriod)
+	}
+
+	if err := shutdown(servers, admin, shutdownDelay, shutdownGracePeriod); err != nil {
+		logger.Warn("shutdown cut connections off", "error", err)
+		return
+	}
+	logger.Info("shutdown complete")
 }
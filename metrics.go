@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kinds of metric, as named in the Prometheus exposition format
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// latencyBuckets are the histogram upper bounds for latencies, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ratioBuckets are the histogram upper bounds for compressed to original size
+var ratioBuckets = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+
+// metric is a counter, gauge or histogram with a series per combination of label values
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// metrics are written out in the order they're declared
+var metrics []*metric
+
+func newMetric(kind, name, help string, buckets []float64, labels ...string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric(metricCounter, name, help, nil, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric(metricGauge, name, help, nil, labels...)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return newMetric(metricHistogram, name, help, buckets, labels...)
+}
+
+var (
+	requestsTotal = newCounter("goproxy_requests_total",
+		"Requests handled, by route prefix, method and status.", "route", "method", "status")
+	requestDuration = newHistogram("goproxy_request_duration_seconds",
+		"Time to handle a request, by route prefix, method and status.", latencyBuckets, "route", "method", "status")
+	requestsInFlight = newGauge("goproxy_requests_in_flight",
+		"Requests currently being handled.")
+	authTotal = newCounter("goproxy_auth_total",
+		"Authentication attempts, by result: ok or the reason it failed.", "result")
+	cognitoDuration = newHistogram("goproxy_cognito_admin_get_user_duration_seconds",
+		"Time taken by Cognito AdminGetUser calls.", latencyBuckets)
+	cognitoErrors = newCounter("goproxy_cognito_admin_get_user_errors_total",
+		"Failed Cognito AdminGetUser calls, by AWS error code.", "code")
+	upstreamDuration = newHistogram("goproxy_upstream_duration_seconds",
+		"Time until an upstream's response headers arrive, by upstream.", latencyBuckets, "upstream")
+	gzipRatio = newHistogram("goproxy_gzip_compression_ratio",
+		"Compressed size of gzipped responses over their original size.", ratioBuckets)
+)
+
+// metricMethods are the methods with series of their own. Clients choose the
+// method, so any other one is counted as OTHER to keep the series bounded.
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+func metricMethod(method string) string {
+	if metricMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// seriesFor returns the series for values, creating it. Callers hold m.mu.
+func (m *metric) seriesFor(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: values, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds delta to a counter or gauge
+func (m *metric) add(delta float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesFor(values).value += delta
+}
+
+func (m *metric) inc(values ...string) {
+	m.add(1, values...)
+}
+
+// value returns the current value of a counter or gauge
+func (m *metric) value(values ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.seriesFor(values).value
+}
+
+// observe records v in a histogram
+func (m *metric) observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.seriesFor(values)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// write writes m in the Prometheus text format
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.WriteString("# HELP " + m.name + " " + m.help + "\n")
+	w.WriteString("# TYPE " + m.name + " " + m.kind + "\n")
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Unlabelled gauges and counters are zero until something happens
+	if len(keys) == 0 && len(m.labels) == 0 && m.kind != metricHistogram {
+		w.WriteString(m.name + " 0\n")
+	}
+
+	for _, key := range keys {
+		s := m.series[key]
+		labels := m.labelPairs(s.labels)
+
+		if m.kind != metricHistogram {
+			w.WriteString(m.name + braced(labels) + " " + formatMetricValue(s.value) + "\n")
+			continue
+		}
+
+		for i, bound := range m.buckets {
+			bucket := append(labels, `le="`+formatMetricValue(bound)+`"`)
+			w.WriteString(m.name + "_bucket" + braced(bucket) + " " + strconv.FormatUint(s.counts[i], 10) + "\n")
+		}
+		w.WriteString(m.name + "_bucket" + braced(append(labels, `le="+Inf"`)) + " " + strconv.FormatUint(s.count, 10) + "\n")
+		w.WriteString(m.name + "_sum" + braced(labels) + " " + formatMetricValue(s.value) + "\n")
+		w.WriteString(m.name + "_count" + braced(labels) + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+func (m *metric) labelPairs(values []string) []string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, value := range values {
+		pairs = append(pairs, m.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	return pairs
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func braced(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serveMetrics answers Prometheus scrapes
+func serveMetrics(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	w := bufio.NewWriter(res)
+	for _, m := range metrics {
+		m.write(w)
+	}
+	w.Flush()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func writeMetric(m *metric) string {
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	m.write(w)
+	w.Flush()
+	return out.String()
+}
+
+func TestMetricFormat(t *testing.T) {
+	counter := &metric{name: "requests_total", help: "Requests.", kind: metricCounter, labels: []string{"path"}, series: make(map[string]*metricSeries)}
+	counter.inc(`/a"b\c`)
+	counter.add(2, "/")
+
+	expected := "# HELP requests_total Requests.\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{path=\"/\"} 2\n" +
+		"requests_total{path=\"/a\\\"b\\\\c\"} 1\n"
+	if result := writeMetric(counter); result != expected {
+		t.Error("'" + result + "' != '" + expected + "'")
+	}
+
+	gauge := &metric{name: "in_flight", help: "In flight.", kind: metricGauge, series: make(map[string]*metricSeries)}
+	if result := writeMetric(gauge); !strings.HasSuffix(result, "\nin_flight 0\n") {
+		t.Error("expected an unlabelled gauge to start at 0, got " + result)
+	}
+
+	histogram := &metric{name: "latency_seconds", help: "Latency.", kind: metricHistogram, buckets: []float64{0.1, 1}, series: make(map[string]*metricSeries)}
+	histogram.observe(0.05)
+	histogram.observe(0.5)
+	histogram.observe(5)
+
+	cases := [][]string{
+		{`latency_seconds_bucket{le="0.1"}`, "1"},
+		{`latency_seconds_bucket{le="1"}`, "2"},
+		{`latency_seconds_bucket{le="+Inf"}`, "3"},
+		{`latency_seconds_sum`, "5.55"},
+		{`latency_seconds_count`, "3"},
+	}
+	result := writeMetric(histogram)
+	for _, i := range cases {
+		if !strings.Contains(result, "\n"+i[0]+" "+i[1]+"\n") {
+			t.Error("'" + result + "' doesn't contain '" + i[0] + " " + i[1] + "'")
+		}
+	}
+}
+
+func TestAuthResult(t *testing.T) {
+	cases := []struct {
+		err    error
+		result string
+	}{
+		{nil, "ok"},
+		{errNoAuthorization, "missing_header"},
+		{errMalformedAuthorization, "malformed_header"},
+		{errNoClientCertificate, "no_certificate"},
+		{errUserDisabled, "disabled"},
+		{errUserUnconfirmed, "unconfirmed"},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorExpired}, "expired"},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorSignatureInvalid}, "bad_signature"},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorUnverifiable}, "bad_signature"},
+		{&jwt.ValidationError{Errors: jwt.ValidationErrorMalformed}, "malformed_token"},
+		{awserr.New("UserNotFoundException", "User does not exist.", nil), "cognito_error"},
+		{errors.New("token audience does not match client id"), "invalid"},
+	}
+	for _, i := range cases {
+		if result := authResult(i.err); result != i.result {
+			t.Error("'" + result + "' != '" + i.result + "'")
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	handleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/metrics-test", nil))
+	handleRequest(httptest.NewRecorder(), httptest.NewRequest("MADEUP", "/metrics-test", nil))
+
+	res := httptest.NewRecorder()
+	serveMetrics(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("unexpected content type " + res.Header().Get("Content-Type"))
+	}
+
+	body := res.Body.String()
+	for _, series := range []string{
+		`goproxy_requests_total{route="default",method="DELETE",status="401"}`,
+		`goproxy_request_duration_seconds_count{route="default",method="DELETE",status="401"}`,
+		`goproxy_requests_total{route="default",method="OTHER",status="401"}`,
+		`goproxy_auth_total{result="missing_header"}`,
+		`goproxy_requests_in_flight 0`,
+		`# TYPE goproxy_gzip_compression_ratio histogram`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Error("expected " + series + " in " + body)
+		}
+	}
+	if strings.Contains(body, "MADEUP") {
+		t.Error("expected unknown methods to share the OTHER series")
+	}
+}
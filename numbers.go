@@ -1,12 +1,51 @@
 package main
 
-import "regexp"
-
-var numberSequence = regexp.MustCompile(`([a-zA-Z])(\d+)([a-zA-Z]?)`)
-var numberReplacement = []byte(`$1 $2 $3`)
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
+// addWordBoundariesToNumbers surrounds each run of digits that follows a letter
+// with spaces, so that `numbers2and55` becomes `numbers 2 and 55 `. A letter
+// directly after a run is kept with the run and can't start the next one.
 func addWordBoundariesToNumbers(s string) string {
-	b := []byte(s)
-	b = numberSequence.ReplaceAll(b, numberReplacement)
-	return string(b)
+	if strings.IndexFunc(s, unicode.IsDigit) < 0 {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s) + 8)
+	for i := 0; i < len(s); {
+		v, size := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(s[i : i+size])
+		i += size
+
+		if !unicode.IsLetter(v) {
+			continue
+		}
+
+		digits := i
+		for digits < len(s) {
+			d, size := utf8.DecodeRuneInString(s[digits:])
+			if !unicode.IsDigit(d) {
+				break
+			}
+			digits += size
+		}
+		if digits == i {
+			continue
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(s[i:digits])
+		b.WriteByte(' ')
+		i = digits
+
+		if next, size := utf8.DecodeRuneInString(s[i:]); i < len(s) && unicode.IsLetter(next) {
+			b.WriteString(s[i : i+size])
+			i += size
+		}
+	}
+	return b.String()
 }
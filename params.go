@@ -0,0 +1,108 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// convertQuery renames the parameters of a raw query string or form body to the
+// style t. Values, their encoding and the parameter order are left untouched.
+func convertQuery(raw string, t string, p ConversionPolicy) (string, error) {
+	if raw == "" {
+		return raw, nil
+	}
+
+	pairs := strings.Split(raw, "&")
+	names := make([]string, len(pairs))
+	originals := make([]string, len(pairs))
+	owners := make(map[string]string, len(pairs))
+	collided := make(map[string]bool)
+	for i, pair := range pairs {
+		key := pair
+		if n := strings.IndexByte(pair, '='); n >= 0 {
+			key = pair[:n]
+		}
+
+		original, err := url.QueryUnescape(key)
+		if err != nil {
+			return raw, err
+		}
+
+		// Repeated parameters with the same name are a list, not a collision
+		name := convertKey(original, t, p.RoundTrip)
+		if owner, seen := owners[name]; !seen {
+			owners[name] = original
+		} else if owner != original {
+			if p.Collisions == CollisionError {
+				return raw, &KeyCollisionError{Keys: []string{owner, original}, Converted: name}
+			}
+			collided[name] = true
+		}
+
+		names[i] = name
+		originals[i] = original
+	}
+
+	var b strings.Builder
+	b.Grow(len(raw))
+	for i, pair := range pairs {
+		name := names[i]
+		if collided[name] {
+			if p.Collisions == CollisionKeepOriginal {
+				name = originals[i]
+			} else if originals[i] != owners[name] {
+				continue
+			}
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(name))
+		if n := strings.IndexByte(pair, '='); n >= 0 {
+			b.WriteString(pair[n:])
+		}
+	}
+
+	return b.String(), nil
+}
+
+// convertURLQuery renames the query parameters of an absolute or relative URL
+func convertURLQuery(raw string, t string, p ConversionPolicy) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw, err
+	}
+
+	if u.RawQuery == "" {
+		return raw, nil
+	}
+
+	u.RawQuery, err = convertQuery(u.RawQuery, t, p)
+	if err != nil {
+		return raw, err
+	}
+
+	return u.String(), nil
+}
+
+func convertRequestQuery(req *http.Request, route *RouteConfig) error {
+	if !route.ConvertQuery {
+		return nil
+	}
+
+	query, err := convertQuery(req.URL.RawQuery, "camel", conversionPolicy)
+	if err != nil {
+		return err
+	}
+
+	req.URL.RawQuery = query
+	return nil
+}
+
+func isFormContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestConvertQuery(t *testing.T) {
+	cases := [][]string{
+		{"user_id=1&page_size=20", "camel", "userId=1&pageSize=20"},
+		{"userId=1&pageSize=20", "snake", "user_id=1&page_size=20"},
+		{"tag_name=a&tag_name=b", "camel", "tagName=a&tagName=b"},
+		{"first_name=J%C3%BCrgen+M&flag", "camel", "firstName=J%C3%BCrgen+M&flag"},
+		{"sort%5Bfield_name%5D=asc", "camel", "sort%5BfieldName%5D=asc"},
+		{"", "camel", ""},
+	}
+	for _, i := range cases {
+		result, err := convertQuery(i[0], i[1], ConversionPolicy{})
+		if err != nil {
+			t.Error(err)
+		}
+		if result != i[2] {
+			t.Error("'" + i[0] + "' ('" + result + "' != '" + i[2] + "')")
+		}
+	}
+}
+
+func TestConvertQueryCollisions(t *testing.T) {
+	query := "userId=1&user_id=2&userId=3"
+
+	if _, err := convertQuery(query, "snake", ConversionPolicy{Collisions: CollisionError}); err == nil {
+		t.Error("expected a collision error")
+	}
+
+	cases := []struct {
+		policy CollisionPolicy
+		out    string
+	}{
+		{CollisionKeepFirst, "user_id=1&user_id=3"},
+		{CollisionKeepOriginal, "userId=1&user_id=2&userId=3"},
+	}
+	for _, i := range cases {
+		result, err := convertQuery(query, "snake", ConversionPolicy{Collisions: i.policy})
+		if err != nil {
+			t.Error(err)
+		}
+		if result != i.out {
+			t.Error("'" + result + "' != '" + i.out + "'")
+		}
+	}
+}
+
+func TestConvertURLQuery(t *testing.T) {
+	result, err := convertURLQuery("https://api.example.com/users?pageSize=20&nextCursor=abc", "snake", ConversionPolicy{})
+	if err != nil {
+		t.Error(err)
+	}
+	if result != "https://api.example.com/users?page_size=20&next_cursor=abc" {
+		t.Error(result)
+	}
+}
+
+func TestFormRequestBody(t *testing.T) {
+	route := &RouteConfig{ConvertForm: true}
+	req, _ := http.NewRequest(http.MethodPost, "/users", strings.NewReader("first_name=Ada&last_name=Lovelace"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	valid, err := validJSONRequestBody(req, route)
+	if err != nil || !valid {
+		t.Fatal("expected the form body to be accepted")
+	}
+
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if req.PostForm.Get("firstName") != "Ada" || req.PostForm.Get("lastName") != "Lovelace" {
+		t.Error(req.PostForm)
+	}
+
+	// Routes without form conversion still only accept JSON
+	req, _ = http.NewRequest(http.MethodPost, "/users", strings.NewReader("first_name=Ada"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if valid, _ := validJSONRequestBody(req, &RouteConfig{}); valid {
+		t.Error("expected the form body to be rejected")
+	}
+}
+
+func TestRouteLookup(t *testing.T) {
+	config := &ProxyConfig{Routes: []RouteConfig{
+		{Prefix: "/", ConvertQuery: false},
+		{Prefix: "/search", ConvertQuery: true},
+	}}
+
+	if !config.route("/search/users").ConvertQuery {
+		t.Error("expected the longest prefix to win")
+	}
+	if config.route("/users").ConvertQuery {
+		t.Error("expected the root route")
+	}
+	for _, path := range []string{"/search", "/search/", "/search/users"} {
+		if !config.route(path).ConvertQuery {
+			t.Error("expected " + path + " to match /search")
+		}
+	}
+	for _, path := range []string{"/searches", "/search-internal"} {
+		if config.route(path).ConvertQuery {
+			t.Error("expected " + path + " not to match /search")
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/search?user_id=1", nil)
+	if err := convertRequestQuery(req, config.route(req.URL.Path)); err != nil {
+		t.Error(err)
+	}
+	if req.URL.Query().Get("userId") != "1" {
+		t.Error(req.URL.RawQuery)
+	}
+	if _, err := url.ParseQuery(req.URL.RawQuery); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryCollisionResponse(t *testing.T) {
+	previous, previousPolicy := proxyConfig, conversionPolicy
+	proxyConfig = &ProxyConfig{Routes: []RouteConfig{{Prefix: "/search", ConvertQuery: true}}}
+	conversionPolicy = ConversionPolicy{Collisions: CollisionError}
+	defer func() { proxyConfig, conversionPolicy = previous, previousPolicy }()
+
+	res := httptest.NewRecorder()
+	handleRequest(res, httptest.NewRequest(http.MethodGet, "/search?user_id=1&userId=2", nil))
+
+	expected := `Query string keys \"user_id\", \"userId\" collide after conversion`
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), expected) {
+		t.Errorf("expected 400 naming the keys, got %d %s", res.Code, res.Body.String())
+	}
+}
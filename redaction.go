@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RedactionConfig decides what is hidden in logged requests and responses
+type RedactionConfig struct {
+	// Headers are header names whose values are hidden
+	Headers []string `json:"headers"`
+	// Keys are glob patterns matched against JSON keys and query parameters at
+	// any depth. Case, "_" and "-" are ignored, so "*apikey*" matches "x_api_key".
+	Keys []string `json:"keys"`
+	// Paths are dotted paths from the root of a JSON body, where "*" matches any
+	// key or array index, eg "customer.addresses.*.street"
+	Paths []string `json:"paths"`
+	// Mode is "mask" (the default) to replace values with [REDACTED], or "hash" to
+	// replace them with a truncated, salted SHA-256 so equal values can be correlated
+	Mode string `json:"mode"`
+	Salt string `json:"salt"`
+	// DisableDefaults drops the built in secret headers and keys
+	DisableDefaults bool `json:"disableDefaults"`
+}
+
+const redactedValue = "[REDACTED]"
+
+var defaultRedactedHeaders = []string{
+	"Cookie",
+	"Set-Cookie",
+	"Proxy-Authorization",
+	"X-Api-Key",
+	"X-Amz-Security-Token",
+	"X-Csrf-Token",
+}
+
+var defaultRedactedKeys = []string{
+	"*password*",
+	"*passwd*",
+	"*secret*",
+	"*token*",
+	"*apikey*",
+	"*privatekey*",
+	"authorization",
+	"cookie",
+	"ssn",
+	"cvv",
+	"cardnumber",
+	"creditcard*",
+}
+
+// redactionPolicy is a compiled RedactionConfig
+type redactionPolicy struct {
+	headers map[string]bool
+	keys    []string
+	paths   [][]string
+	hash    bool
+	salt    string
+}
+
+// redaction is the policy logs are written with, the defaults until init loads the config
+var redaction, _ = (*RedactionConfig)(nil).compile()
+
+// compile checks the patterns and merges in the defaults. A nil config gives the defaults.
+func (c *RedactionConfig) compile() (*redactionPolicy, error) {
+	if c == nil {
+		c = &RedactionConfig{}
+	}
+
+	p := &redactionPolicy{headers: make(map[string]bool), salt: c.Salt}
+
+	switch c.Mode {
+	case "", "mask":
+	case "hash":
+		p.hash = true
+	default:
+		return nil, fmt.Errorf("unknown redaction mode: %s", c.Mode)
+	}
+
+	headers, keys := c.Headers, c.Keys
+	if !c.DisableDefaults {
+		headers = append(append([]string{}, defaultRedactedHeaders...), headers...)
+		keys = append(append([]string{}, defaultRedactedKeys...), keys...)
+	}
+
+	for _, name := range headers {
+		p.headers[http.CanonicalHeaderKey(name)] = true
+	}
+
+	for _, pattern := range keys {
+		pattern = normalizeRedactedKey(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad redaction key pattern %s: %s", pattern, err)
+		}
+		p.keys = append(p.keys, pattern)
+	}
+
+	for _, dotted := range c.Paths {
+		if dotted == "" {
+			return nil, fmt.Errorf("empty redaction path")
+		}
+		p.paths = append(p.paths, strings.Split(dotted, "."))
+	}
+
+	return p, nil
+}
+
+func normalizeRedactedKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+func (p *redactionPolicy) header(name string) bool {
+	return p.headers[http.CanonicalHeaderKey(name)]
+}
+
+func (p *redactionPolicy) key(name string) bool {
+	name = normalizeRedactedKey(name)
+	for _, pattern := range p.keys {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *redactionPolicy) path(segments []string) bool {
+	for _, pattern := range p.paths {
+		if len(pattern) != len(segments) {
+			continue
+		}
+
+		matched := true
+		for i := range pattern {
+			if pattern[i] != "*" && pattern[i] != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns what is logged in place of v
+func (p *redactionPolicy) value(v interface{}) string {
+	if !p.hash {
+		return redactedValue
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		b, _ := json.Marshal(v)
+		s = string(b)
+	}
+
+	sum := sha256.Sum256([]byte(p.salt + s))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// body redacts a decoded JSON value in place, returning the redacted value
+func (p *redactionPolicy) body(v interface{}) interface{} {
+	return p.walk(v, nil)
+}
+
+func (p *redactionPolicy) walk(v interface{}, segments []string) interface{} {
+	if len(segments) > 0 && p.path(segments) {
+		return p.value(v)
+	}
+
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if p.key(key) {
+				node[key] = p.value(child)
+				continue
+			}
+			node[key] = p.walk(child, append(segments, key))
+		}
+	case []interface{}:
+		for i, child := range node {
+			node[i] = p.walk(child, append(segments, strconv.Itoa(i)))
+		}
+	}
+
+	return v
+}
+
+// query returns a copy of values with redacted parameters hidden
+func (p *redactionPolicy) query(values url.Values) url.Values {
+	redacted := make(url.Values, len(values))
+	for key, list := range values {
+		if !p.key(key) {
+			redacted[key] = list
+			continue
+		}
+
+		for _, value := range list {
+			redacted[key] = append(redacted[key], p.value(value))
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	policy, err := (&RedactionConfig{Keys: []string{"email"}, Paths: []string{"customer.addresses.*.street", "notes"}}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [][]string{
+		{`{"userName":"ada","password":"hunter2"}`, `{"password":"[REDACTED]","userName":"ada"}`},
+		{`{"auth":{"access_token":"abc","tokenType":"Bearer"}}`, `{"auth":{"access_token":"[REDACTED]","tokenType":"[REDACTED]"}}`},
+		{`{"items":[{"X-Api-Key":"k","id":1}]}`, `{"items":[{"X-Api-Key":"[REDACTED]","id":1}]}`},
+		{`{"clientSecret":{"nested":true}}`, `{"clientSecret":"[REDACTED]"}`},
+		{`{"Email":"ada@example.com"}`, `{"Email":"[REDACTED]"}`},
+		{`{"customer":{"addresses":[{"street":"Main","city":"Paris"}],"street":"kept"}}`, `{"customer":{"addresses":[{"city":"Paris","street":"[REDACTED]"}],"street":"kept"}}`},
+		{`{"notes":["a","b"],"other":{"notes":"kept"}}`, `{"notes":"[REDACTED]","other":{"notes":"kept"}}`},
+	}
+	for _, i := range cases {
+		var body interface{}
+		json.Unmarshal([]byte(i[0]), &body)
+		result, _ := json.Marshal(policy.body(body))
+		if string(result) != i[1] {
+			t.Error("'" + i[0] + "' ('" + string(result) + "' != '" + i[1] + "')")
+		}
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	policy, err := (&RedactionConfig{Mode: "hash", Salt: "pepper"}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := policy.value("hunter2"), policy.value("hunter2")
+	if first != second || !strings.HasPrefix(first, "sha256:") || strings.Contains(first, "hunter2") {
+		t.Error("expected equal values to hash the same, got " + first + " and " + second)
+	}
+	if policy.value("hunter3") == first {
+		t.Error("expected different values to hash differently")
+	}
+
+	unsalted, _ := (&RedactionConfig{Mode: "hash"}).compile()
+	if unsalted.value("hunter2") == first {
+		t.Error("expected the salt to change the hash")
+	}
+}
+
+func TestRedactHeadersAndQuery(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Cookie", "session=abc")
+	headers.Set("Set-Cookie", "session=abc; HttpOnly")
+	headers.Set("X-Api-Key", "key")
+	headers.Set("Authorization", "Bearer token")
+	headers.Set("Accept", "application/json")
+
+	cases := [][]string{
+		{"Cookie", redactedValue},
+		{"Set-Cookie", redactedValue},
+		{"X-Api-Key", redactedValue},
+		{"Authorization", "true"},
+		{"Accept", "application/json"},
+	}
+	parsed := transformHeaders(headers)
+	for _, i := range cases {
+		if parsed[i[0]] != i[1] {
+			t.Error(i[0] + ": '" + parsed[i[0]] + "' != '" + i[1] + "'")
+		}
+	}
+
+	query := redaction.query(url.Values{"access_token": {"abc"}, "page": {"2"}})
+	if query.Get("access_token") != redactedValue || query.Get("page") != "2" {
+		t.Error("unexpected query " + query.Encode())
+	}
+}
+
+func TestRedactLoggedRequestURI(t *testing.T) {
+	previous, previousAccess := logger, accessLog
+	l, out := testLogger(t, FormatJSON, LevelInfo)
+	var accessOut bytes.Buffer
+	logger, accessLog = l, &accessLogger{format: AccessLogCommon, sink: writerSink{&accessOut}}
+	defer func() { logger, accessLog = previous, previousAccess }()
+
+	req := httptest.NewRequest(http.MethodGet, "/login?password=hunter2&page=2", nil)
+	req.Header.Set("Referer", "https://app.example.com/reset?access_token=s3cret&step=2")
+	handleRequest(httptest.NewRecorder(), req)
+
+	expected := "/login?page=2&password=%5BREDACTED%5D"
+	var request map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "incoming request" {
+			request, _ = record["request"].(map[string]interface{})
+		}
+	}
+	if request["requestURI"] != expected {
+		t.Errorf("'%v' != '%s'", request["requestURI"], expected)
+	}
+
+	if !strings.Contains(accessOut.String(), `"GET `+expected+` HTTP/1.1"`) {
+		t.Error("expected the access log to show the redacted query: " + accessOut.String())
+	}
+	if strings.Contains(out.String()+accessOut.String(), "hunter2") {
+		t.Error("password was logged")
+	}
+
+	// The referer is redacted in the request log and the combined and JSON access logs
+	referer := "https://app.example.com/reset?access_token=%5BREDACTED%5D&step=2"
+	if headers, _ := request["headers"].(map[string]interface{}); headers["Referer"] != referer {
+		t.Errorf("'%v' != '%s'", headers["Referer"], referer)
+	}
+	for _, format := range []string{AccessLogCombined, AccessLogJSON} {
+		accessOut.Reset()
+		accessLog = &accessLogger{format: format, sink: writerSink{&accessOut}}
+		handleRequest(httptest.NewRecorder(), req)
+		if !strings.Contains(accessOut.String(), "/reset?access_token=%5BREDACTED%5D") || strings.Contains(accessOut.String(), "s3cret") {
+			t.Error(format + ": expected the redacted referer: " + accessOut.String())
+		}
+	}
+}
+
+func TestRedactionConfigValidation(t *testing.T) {
+	cases := []*RedactionConfig{
+		{Mode: "encrypt"},
+		{Keys: []string{"[password"}},
+		{Paths: []string{""}},
+	}
+	for _, i := range cases {
+		if _, err := i.compile(); err == nil {
+			t.Errorf("expected %+v to be rejected", i)
+		}
+	}
+
+	policy, _ := (&RedactionConfig{DisableDefaults: true}).compile()
+	if policy.key("password") || policy.header("Cookie") {
+		t.Error("expected the defaults to be disabled")
+	}
+}
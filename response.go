@@ -6,33 +6,74 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type transport struct {
 	http.RoundTripper
+	route *RouteConfig
 }
 
 func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	ctx, span := startSpan(req.Context(), "upstream "+req.Method, SpanKindClient,
+		"http.method", req.Method, "http.target", req.URL.Path, "net.peer.name", req.URL.Host)
+	injectTraceContext(ctx, req.Header)
+
+	started := time.Now()
 	resp, err = t.RoundTripper.RoundTrip(req)
+	if record := accessRecordFrom(req.Context()); record != nil {
+		record.upstreamLatency = time.Since(started)
+		upstreamDuration.observe(record.upstreamLatency.Seconds(), record.upstream)
+	}
 	if err != nil {
+		span.SetError(err)
+		span.End()
 		return nil, err
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	span.SetAttributes("http.status_code", resp.StatusCode)
+	span.End()
+
+	if err := convertResponseHeaders(resp.Header, t.route); err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
 
-	err = resp.Body.Close()
+	resp.Header.Del("Authorization")
+	resp.Header.Del("X-Powered-By")
+	// The proxy already answers with the request ID it forwarded
+	resp.Header.Del(requestIDHeader)
+
+	// Anything we don't convert streams through with the upstream's own headers
+	if !t.convertsBody(resp) {
+		logResponse(resp)
+		return resp, nil
+	}
+
+	b, stream, err := bufferBody(resp.Body, resp.ContentLength)
 	if err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
 
-	if IsJSON(b) {
-		resp.Header.Set("Content-Type", "application/json")
-		b = convertKeys(json.RawMessage(b), "snake")
-	} else {
-		resp.Header.Set("Content-Type", "text/plain")
+	if stream != nil {
+		resp.Body = stream
+		logResponse(resp)
+		return resp, nil
+	}
+
+	_, conversion := startSpan(req.Context(), "convert response keys", SpanKindInternal)
+	if isFormContent(resp.Header.Get("Content-Type")) {
+		var form string
+		form, err = convertQuery(string(b), "snake", conversionPolicy)
+		b = []byte(form)
+	} else if IsJSON(b) {
+		b, err = convertKeys(json.RawMessage(b), "snake", conversionPolicy)
+	}
+	conversion.SetError(err)
+	conversion.End()
+	if err != nil {
+		return nil, err
 	}
 
 	body := ioutil.NopCloser(bytes.NewReader(b))
@@ -42,10 +83,23 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 
 	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
 
-	resp.Header.Del("Authorization")
-	resp.Header.Del("X-Powered-By")
-
 	logResponse(resp)
 
 	return resp, nil
 }
+
+// convertsBody reports whether the response body is declared as a type we
+// rename keys in. Encoded bodies are left alone since they can't be parsed.
+func (t *transport) convertsBody(resp *http.Response) bool {
+	if isEncoded(resp.Header) {
+		return false
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	return isJSONContent(contentType) || (t.route.ConvertForm && isFormContent(contentType))
+}
+
+func isEncoded(header http.Header) bool {
+	encoding := header.Get("Content-Encoding")
+	return encoding != "" && encoding != "identity"
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransportContentTypes(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 0}
+	cases := []struct {
+		contentType string
+		body        []byte
+		out         []byte
+	}{
+		{"application/json; charset=utf-8", []byte(`{"userId":1}`), []byte(`{"user_id":1}`)},
+		{"application/problem+json", []byte(`{"errorCode":"x"}`), []byte(`{"error_code":"x"}`)},
+		{"image/png", png, png},
+		{"text/csv", []byte("userId,firstName\n1,Ada\n"), []byte("userId,firstName\n1,Ada\n")},
+		{"text/html", []byte(`{"looksLike":"json"}`), []byte(`{"looksLike":"json"}`)},
+		{"application/json", []byte(`not json`), []byte(`not json`)},
+	}
+
+	for _, i := range cases {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", i.contentType)
+			w.Write(i.body)
+		}))
+
+		client := &http.Client{Transport: &transport{RoundTripper: http.DefaultTransport, route: &RouteConfig{}}}
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		upstream.Close()
+
+		if resp.Header.Get("Content-Type") != i.contentType {
+			t.Error("'" + resp.Header.Get("Content-Type") + "' != '" + i.contentType + "'")
+		}
+		if !bytes.Equal(body, i.out) {
+			t.Error(i.contentType + ": '" + string(body) + "' != '" + string(i.out) + "'")
+		}
+	}
+}
+
+// failingBody fails every read and records whether it was closed
+type failingBody struct {
+	closed bool
+}
+
+func (b *failingBody) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func (b *failingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransportClosesBodyOnReadError(t *testing.T) {
+	body := &failingBody{}
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          body,
+			ContentLength: -1,
+			Request:       req,
+		}, nil
+	})
+
+	proxy := &transport{RoundTripper: upstream, route: &RouteConfig{}}
+	if _, err := proxy.RoundTrip(httptest.NewRequest(http.MethodGet, "http://upstream/users", nil)); err == nil {
+		t.Error("expected the read error")
+	}
+	if !body.closed {
+		t.Error("expected the upstream body to be closed")
+	}
+}
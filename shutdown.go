@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// shuttingDown is set once a shutdown starts, failing readiness
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// hijacked holds upgraded connections, such as WebSockets, which
+// http.Server.Shutdown neither waits for nor closes
+var hijacked = &connTracker{conns: make(map[*trackedConn]struct{})}
+
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+// track returns conn, counted until it's closed
+func (t *connTracker) track(conn net.Conn) net.Conn {
+	c := &trackedConn{Conn: conn, tracker: t}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[c] = struct{}{}
+	return c
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.mu.Lock()
+		defer c.tracker.mu.Unlock()
+		delete(c.tracker.conns, c)
+	})
+	return c.Conn.Close()
+}
+
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// wait waits for every connection to close, closing what's left once ctx is done
+func (t *connTracker) wait(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for t.count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.mu.Lock()
+			conns := make([]*trackedConn, 0, len(t.conns))
+			for c := range t.conns {
+				conns = append(conns, c)
+			}
+			t.mu.Unlock()
+
+			for _, c := range conns {
+				c.Close()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// configureHTTP2 serves handler on server over HTTP/2 as well, with TLS or in
+// cleartext (h2c). h2c connections are hijacked from the server, so the HTTP/2
+// server is hooked into its shutdown to send them a GOAWAY too.
+func configureHTTP2(server *http.Server, handler http.Handler) error {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(server, h2s); err != nil {
+		return err
+	}
+	server.Handler = h2c.NewHandler(handler, h2s)
+	return nil
+}
+
+// waitForRequests waits until no request is in flight, or ctx is done
+func waitForRequests(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for requestsInFlight.value() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// shutdown drains servers. Readiness fails straight away, and after delay, for
+// load balancers to notice, the servers stop accepting connections. In-flight
+// requests, streams and upgraded connections then get grace to finish before
+// they're cut off. The admin server, if any, answers probes until the end.
+func shutdown(servers []*http.Server, admin *http.Server, delay, grace time.Duration) error {
+	atomic.StoreInt32(&shuttingDown, 1)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var drained error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+			drained = errors.New("grace period ended before every request finished")
+		}
+	}
+
+	// Shutdown doesn't wait for the streams of h2c connections, only tells them to stop
+	if err := waitForRequests(ctx); err != nil {
+		drained = errors.New("grace period ended before every request finished")
+	}
+
+	if err := hijacked.wait(ctx); err != nil {
+		drained = errors.New("grace period ended before every upgraded connection closed")
+	}
+
+	if admin != nil {
+		admin.Close()
+	}
+
+	// Spans of the last requests still need sending
+	flush, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if tracing.enabled() {
+		if err := tracing.exporter.Shutdown(flush); err != nil {
+			logger.Warn("unable to send the last spans", "error", err)
+		}
+	}
+
+	return drained
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func testServer(t *testing.T, handler http.Handler) (*http.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	return server, "http://" + listener.Addr().String()
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	started := make(chan struct{})
+	server, base := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("finished"))
+	}))
+
+	responses := make(chan string, 1)
+	go func() {
+		res, err := http.Get(base + "/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		responses <- string(body)
+	}()
+	<-started
+
+	done := make(chan error, 1)
+	go func() { done <- shutdown([]*http.Server{server}, nil, 50*time.Millisecond, 5*time.Second) }()
+
+	time.Sleep(10 * time.Millisecond)
+	res := httptest.NewRecorder()
+	serveReady(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Error("expected readiness to fail as soon as the shutdown starts")
+	}
+
+	if body := <-responses; body != "finished" {
+		t.Error("'" + body + "' != 'finished'")
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if _, err := http.Get(base + "/slow"); err == nil {
+		t.Error("expected new connections to be refused after the shutdown")
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	upgraded := make(chan net.Conn, 1)
+	server, base := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+
+		conn, rw, err := (&accessLogResponseWriter{ResponseWriter: w}).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+		upgraded <- conn
+	}))
+
+	stream, err := http.Get(base + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	socket, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	socket.Write([]byte("GET /socket HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	if status, _ := bufio.NewReader(socket).ReadString('\n'); status != "HTTP/1.1 101 Switching Protocols\r\n" {
+		t.Fatalf("unexpected upgrade response %q", status)
+	}
+	<-upgraded
+
+	if hijacked.count() != 1 {
+		t.Fatalf("expected the upgraded connection to be tracked, got %d", hijacked.count())
+	}
+
+	if err := shutdown([]*http.Server{server}, nil, 0, 100*time.Millisecond); err == nil {
+		t.Error("expected a shutdown cut short by the grace period to say so")
+	}
+
+	if _, err := ioutil.ReadAll(stream.Body); err == nil {
+		t.Error("expected the open stream to be cut off")
+	}
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := socket.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the upgraded connection to be closed")
+	}
+	if hijacked.count() != 0 {
+		t.Error("expected no tracked connections left")
+	}
+}
+
+func TestShutdownDrainsH2CStreams(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	started := make(chan struct{})
+	var finished int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{}
+	if err := configureHTTP2(server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsInFlight.add(1)
+		defer requestsInFlight.add(-1)
+
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("finished"))
+		atomic.StoreInt32(&finished, 1)
+	})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	// Prior knowledge h2c, the way gRPC clients connect
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	responses := make(chan string, 1)
+	go func() {
+		res, err := client.Get("http://" + listener.Addr().String() + "/stream")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		responses <- res.Proto + " " + string(body)
+	}()
+	<-started
+
+	if err := shutdown([]*http.Server{server}, nil, 0, 5*time.Second); err != nil {
+		t.Error(err)
+	}
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("expected the shutdown to wait for the h2c stream")
+	}
+	if body := <-responses; body != "HTTP/2.0 finished" {
+		t.Error("'" + body + "' != 'HTTP/2.0 finished'")
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ToSnake converts a string to snake_case
@@ -33,36 +35,45 @@ func ToDelimited(s string, del uint8) string {
 func ToScreamingDelimited(s string, del uint8, screaming bool) string {
 	s = addWordBoundariesToNumbers(s)
 	s = strings.Trim(s, " ")
-	n := ""
+	toCase := unicode.ToLower
+	if screaming {
+		toCase = unicode.ToUpper
+	}
+
+	var n strings.Builder
+	n.Grow(len(s) + 4)
+	last := rune(0)
+	write := func(v rune) {
+		n.WriteRune(v)
+		last = v
+	}
+
 	for i, v := range s {
 		// treat acronyms as words, eg for JSONData -> JSON is a whole word
 		nextCaseIsChanged := false
-		if i+1 < len(s) {
-			next := s[i+1]
-			if (v >= 'A' && v <= 'Z' && next >= 'a' && next <= 'z') || (v >= 'a' && v <= 'z' && next >= 'A' && next <= 'Z') {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		if next, _ := utf8.DecodeRuneInString(s[i+size:]); i+size < len(s) {
+			if (unicode.IsUpper(v) && unicode.IsLower(next)) || (unicode.IsLower(v) && unicode.IsUpper(next)) {
 				nextCaseIsChanged = true
 			}
 		}
 
-		if i > 0 && n[len(n)-1] != del && nextCaseIsChanged {
+		if i > 0 && last != rune(del) && nextCaseIsChanged {
 			// add underscore if next letter case type is changed
-			if v >= 'A' && v <= 'Z' {
-				n += string(del) + string(v)
-			} else if v >= 'a' && v <= 'z' {
-				n += string(v) + string(del)
+			if unicode.IsUpper(v) {
+				write(rune(del))
+				write(toCase(v))
+			} else {
+				write(toCase(v))
+				write(rune(del))
 			}
 		} else if v == ' ' || v == '_' || v == '-' {
 			// replace spaces/underscores with delimiters
-			n += string(del)
+			write(rune(del))
 		} else {
-			n = n + string(v)
+			write(toCase(v))
 		}
 	}
 
-	if screaming {
-		n = strings.ToUpper(n)
-	} else {
-		n = strings.ToLower(n)
-	}
-	return n
+	return n.String()
 }
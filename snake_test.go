@@ -120,3 +120,25 @@ func TestToScreamingDelimited(t *testing.T) {
 		}
 	}
 }
+
+func TestToSnakeUnicode(t *testing.T) {
+	cases := [][]string{
+		{"façadeValue", "façade_value"},
+		{"ÜberCool", "über_cool"},
+		{"größeDerDatei", "größe_der_datei"},
+		{"ÉtéChaud", "été_chaud"},
+		{"名前", "名前"},
+		{"名前Field", "名前_field"},
+		{"user.firstName", "user.first_name"},
+		{"straße2Grün", "straße_2_grün"},
+		{"ΑΒΓdata", "αβ_γdata"},
+	}
+	for _, i := range cases {
+		in := i[0]
+		out := i[1]
+		result := ToSnake(in)
+		if result != out {
+			t.Error("'" + in + "'('" + result + "' != '" + out + "')")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+)
+
+// maxBufferedBody is the largest body, in bytes, that is read into memory to be
+// validated, converted and logged. Larger bodies stream through untouched.
+var maxBufferedBody int64 = 10 << 20
+
+type streamedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// bufferBody reads a body of up to maxBufferedBody bytes into memory and closes
+// it. A larger body is returned as a stream instead, replaying the bytes read
+// while finding out its size, so bodies of unknown length keep being chunked.
+func bufferBody(body io.ReadCloser, contentLength int64) ([]byte, io.ReadCloser, error) {
+	if contentLength > maxBufferedBody {
+		return nil, body, nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxBufferedBody+1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if int64(len(b)) > maxBufferedBody {
+		return nil, &streamedBody{Reader: io.MultiReader(bytes.NewReader(b), body), Closer: body}, nil
+	}
+
+	return b, nil, body.Close()
+}
+
+// isBuffered reports whether a body of the given length was held in memory rather than streamed
+func isBuffered(contentLength int64) bool {
+	return contentLength >= 0 && contentLength <= maxBufferedBody
+}
+
+// streamingContentTypes are responses the client reads while the upstream is still writing them
+var streamingContentTypes = map[string]bool{
+	"text/event-stream":      true,
+	"application/x-ndjson":   true,
+	"application/grpc":       true,
+	"application/grpc+proto": true,
+	"application/grpc+json":  true,
+}
+
+func isStreamingContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && streamingContentTypes[mediaType]
+}
+
+// flushingResponseWriter flushes every write of a streaming response to the client
+// as soon as it is made, instead of when the handler's buffers fill up
+type flushingResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	streaming   bool
+}
+
+func (w *flushingResponseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.streaming = isStreamingContent(w.Header().Get("Content-Type"))
+	w.ResponseWriter.WriteHeader(status)
+	if w.streaming {
+		w.Flush()
+	}
+}
+
+func (w *flushingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	if w.streaming {
+		w.Flush()
+	}
+	return n, err
+}
+
+func (w *flushingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *flushingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
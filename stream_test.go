@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// syntheticBody produces a large JSON-looking body without holding it in memory
+type syntheticBody struct {
+	remaining int64
+	offset    int
+}
+
+func (b *syntheticBody) Read(p []byte) (int, error) {
+	const pattern = `{"fooBar":1}`
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	for i := range p {
+		p[i] = pattern[(b.offset+i)%len(pattern)]
+	}
+	b.offset += len(p)
+	b.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+func withMaxBufferedBody(size int64) func() {
+	previous := maxBufferedBody
+	maxBufferedBody = size
+	return func() { maxBufferedBody = previous }
+}
+
+func allocatedDuring(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestBufferBody(t *testing.T) {
+	defer withMaxBufferedBody(16)()
+
+	b, stream, err := bufferBody(ioutil.NopCloser(bytes.NewReader([]byte(`{"a":1}`))), -1)
+	if err != nil || stream != nil || string(b) != `{"a":1}` {
+		t.Error("expected a small body to be buffered")
+	}
+
+	large := bytes.Repeat([]byte("x"), 64)
+	b, stream, err = bufferBody(ioutil.NopCloser(bytes.NewReader(large)), -1)
+	if err != nil || b != nil || stream == nil {
+		t.Fatal("expected a large body to stream")
+	}
+	replayed, _ := ioutil.ReadAll(stream)
+	if !bytes.Equal(replayed, large) {
+		t.Error("streamed body lost the bytes read while sizing it")
+	}
+}
+
+func TestLargeRequestBodyStreams(t *testing.T) {
+	defer withMaxBufferedBody(1 << 20)()
+	const size = 64 << 20
+
+	var received int64
+	var chunked bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunked = len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		received, _ = io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer upstream.Close()
+
+	allocated := allocatedDuring(func() {
+		req, _ := http.NewRequest(http.MethodPost, upstream.URL, ioutil.NopCloser(&syntheticBody{remaining: size}))
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "application/json")
+
+		if valid, err := validJSONRequestBody(req, &RouteConfig{}); err != nil || !valid {
+			t.Fatal("expected a large body to pass through")
+		}
+		logRequest(req)
+
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	})
+
+	if received != size {
+		t.Errorf("upstream received %d of %d bytes", received, size)
+	}
+	if !chunked {
+		t.Error("expected the request to stay chunked")
+	}
+	if allocated > 16<<20 {
+		t.Errorf("allocated %d bytes proxying a %d byte body", allocated, size)
+	}
+}
+
+func TestLargeResponseBodyStreams(t *testing.T) {
+	defer withMaxBufferedBody(1 << 20)()
+	const size = 64 << 20
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, &syntheticBody{remaining: size})
+	}))
+	defer upstream.Close()
+
+	expected := sha256.New()
+	io.Copy(expected, &syntheticBody{remaining: size})
+
+	var resp *http.Response
+	received := sha256.New()
+	allocated := allocatedDuring(func() {
+		client := &http.Client{Transport: &transport{RoundTripper: http.DefaultTransport, route: &RouteConfig{}}}
+		var err error
+		resp, err = client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(received, resp.Body)
+		resp.Body.Close()
+	})
+
+	if !bytes.Equal(received.Sum(nil), expected.Sum(nil)) {
+		t.Error("streamed response body differs from the upstream's")
+	}
+	if resp.ContentLength != -1 {
+		t.Error("expected the response to stay chunked")
+	}
+	if allocated > 16<<20 {
+		t.Errorf("allocated %d bytes proxying a %d byte body", allocated, size)
+	}
+}
+
+func TestEventStreamFlushesThroughGzip(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "data: {\"eventId\":1}\n\n")
+		w.(http.Flusher).Flush()
+
+		// Hold the stream open until the client has seen the first event
+		<-release
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, w, r)
+	})))
+	defer proxy.Close()
+	defer close(release)
+
+	events := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			events <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			events <- err.Error()
+			return
+		}
+		line, _ := bufio.NewReader(gz).ReadString('\n')
+		events <- line
+	}()
+
+	select {
+	case line := <-events:
+		if line != "data: {\"eventId\":1}\n" {
+			t.Error("unexpected event: " + line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("event was held back until the stream closed")
+	}
+}
+
+func TestEventStreamRequiresAuthorization(t *testing.T) {
+	opened := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opened = true
+	}))
+	defer upstream.Close()
+
+	previous := proxyConfig
+	proxyConfig = &ProxyConfig{Upstreams: map[string]*UpstreamConfig{"default": testUpstream(t, upstream.URL)}}
+	defer func() { proxyConfig = previous }()
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res := httptest.NewRecorder()
+	handleRequest(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", res.Code)
+	}
+	if opened {
+		t.Error("stream was opened before authentication")
+	}
+}
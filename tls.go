@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig turns on HTTPS for the proxy's listener
+type TLSConfig struct {
+	// Certificates are picked by the server name the client asks for (SNI), the
+	// first one is used for clients that don't send a name or match no certificate
+	Certificates []CertificateConfig `json:"certificates"`
+	// MinVersion is "1.0", "1.1", "1.2" (the default) or "1.3"
+	MinVersion string `json:"minVersion"`
+	// CipherSuites restricts the TLS 1.2 cipher suites by their Go names, eg
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites can't be configured.
+	CipherSuites []string `json:"cipherSuites"`
+	// RedirectPort, when set, serves plain HTTP on that port redirecting every request to HTTPS
+	RedirectPort string `json:"redirectPort"`
+	// ClientCAFile is a PEM bundle of CAs that client certificates are verified
+	// against. Clients may still connect without one, routes decide if it's needed.
+	ClientCAFile string `json:"clientCAFile"`
+	// ClientUsername is the certificate field used as the username: "commonName"
+	// (the default), "dnsName", "email" or "uri"
+	ClientUsername string `json:"clientUsername"`
+}
+
+// CertificateConfig is a PEM certificate chain and its private key
+type CertificateConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// certificateReloadInterval is how often certificate files are checked for changes
+var certificateReloadInterval = 30 * time.Second
+
+// serverConfig builds the tls.Config for the listener and starts watching the certificate files
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	if len(c.Certificates) == 0 {
+		return nil, errors.New("tls needs at least one certificate")
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version: %s", c.MinVersion)
+		}
+		minVersion = version
+	}
+
+	var cipherSuites []uint16
+	for _, name := range c.CipherSuites {
+		suite, ok := tlsCipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		cipherSuites = append(cipherSuites, suite)
+	}
+
+	clientAuth := tls.NoClientCert
+	var clientCAs *x509.CertPool
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if c.ClientUsername != "" && !clientUsernameFields[c.ClientUsername] {
+		return nil, fmt.Errorf("unknown client username field: %s", c.ClientUsername)
+	}
+
+	store := &certificateStore{files: c.Certificates}
+	if _, err := store.reload(); err != nil {
+		return nil, err
+	}
+	go store.watch(certificateReloadInterval)
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: store.getCertificate,
+		ClientAuth:     clientAuth,
+		ClientCAs:      clientCAs,
+	}, nil
+}
+
+// certificateStore holds the loaded certificates and swaps them out when their files change on disk
+type certificateStore struct {
+	files []CertificateConfig
+
+	mu           sync.RWMutex
+	certificates []*tls.Certificate
+	modified     []time.Time
+}
+
+// reload loads the certificates again when any of their files changed since
+// the last load. A failed reload keeps serving the previous certificates.
+func (s *certificateStore) reload() (bool, error) {
+	modified := make([]time.Time, 0, len(s.files)*2)
+	for _, files := range s.files {
+		for _, name := range []string{files.CertFile, files.KeyFile} {
+			info, err := os.Stat(name)
+			if err != nil {
+				return false, err
+			}
+			modified = append(modified, info.ModTime())
+		}
+	}
+
+	s.mu.RLock()
+	unchanged := len(s.modified) == len(modified)
+	for i := 0; unchanged && i < len(modified); i++ {
+		unchanged = s.modified[i].Equal(modified[i])
+	}
+	s.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	certificates := make([]*tls.Certificate, len(s.files))
+	for i, files := range s.files {
+		certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return false, err
+		}
+
+		certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return false, err
+		}
+		certificates[i] = &certificate
+	}
+
+	s.mu.Lock()
+	s.certificates = certificates
+	s.modified = modified
+	s.mu.Unlock()
+
+	return true, nil
+}
+
+func (s *certificateStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := s.reload()
+		if err != nil {
+			logger.Error("unable to reload tls certificates, keeping the current ones", "error", err)
+			continue
+		}
+
+		if reloaded {
+			logger.Info("reloaded tls certificates")
+		}
+	}
+}
+
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, certificate := range s.certificates {
+			if certificate.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return certificate, nil
+			}
+		}
+	}
+
+	return s.certificates[0], nil
+}
+
+// redirectToHTTPS sends every request to the same host and path over HTTPS on httpsPort
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+		http.Redirect(res, req, target.String(), http.StatusPermanentRedirect)
+	})
+}
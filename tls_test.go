@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for names to dir and returns its files
+func writeCertificate(t *testing.T, dir string, serial int64, names ...string) CertificateConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := CertificateConfig{
+		CertFile: filepath.Join(dir, names[0]+".crt"),
+		KeyFile:  filepath.Join(dir, names[0]+".key"),
+	}
+	ioutil.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return files
+}
+
+func servedCertificate(t *testing.T, addr string, serverName string) *x509.Certificate {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLSCertificateSelection(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	config := &TLSConfig{Certificates: []CertificateConfig{
+		writeCertificate(t, dir, 1, "api.example.com"),
+		writeCertificate(t, dir, 2, "admin.example.com", "*.admin.example.com"),
+	}}
+	tlsConfig, err := config.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.NotFoundHandler())
+	addr := listener.Addr().String()
+
+	cases := map[string]int64{
+		"api.example.com":      1,
+		"admin.example.com":    2,
+		"eu.admin.example.com": 2,
+		"unknown.example.com":  1,
+		"":                     1,
+	}
+	for name, serial := range cases {
+		if certificate := servedCertificate(t, addr, name); certificate.SerialNumber.Int64() != serial {
+			t.Errorf("%s: served certificate %d, expected %d", name, certificate.SerialNumber.Int64(), serial)
+		}
+	}
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	files := writeCertificate(t, dir, 1, "api.example.com")
+	store := &certificateStore{files: []CertificateConfig{files}}
+	if _, err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded, _ := store.reload(); reloaded {
+		t.Error("reloaded certificates that didn't change")
+	}
+
+	writeCertificate(t, dir, 2, "api.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(files.CertFile, later, later)
+
+	if reloaded, err := store.reload(); !reloaded || err != nil {
+		t.Fatalf("expected a reload (%v)", err)
+	}
+	certificate, _ := store.getCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	if certificate.Leaf.SerialNumber.Int64() != 2 {
+		t.Error("still serving the old certificate")
+	}
+
+	// A broken file keeps the current certificate in place
+	ioutil.WriteFile(files.KeyFile, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(files.KeyFile, later, later)
+	if _, err := store.reload(); err == nil {
+		t.Error("expected the broken key to fail")
+	}
+	certificate, _ = store.getCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	if certificate.Leaf.SerialNumber.Int64() != 2 {
+		t.Error("lost the certificate after a failed reload")
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	files := writeCertificate(t, dir, 1, "api.example.com")
+
+	config := &TLSConfig{
+		Certificates: []CertificateConfig{files},
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}
+	tlsConfig, err := config.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 || len(tlsConfig.CipherSuites) != 1 {
+		t.Error("version and cipher suites were not applied")
+	}
+
+	cases := []*TLSConfig{
+		{},
+		{Certificates: []CertificateConfig{files}, MinVersion: "2.0"},
+		{Certificates: []CertificateConfig{files}, CipherSuites: []string{"TLS_NULL"}},
+		{Certificates: []CertificateConfig{{CertFile: "missing.crt", KeyFile: "missing.key"}}},
+	}
+	for _, i := range cases {
+		if _, err := i.serverConfig(); err == nil {
+			t.Error("expected an invalid tls config to be rejected")
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := [][]string{
+		{"api.example.com:80", "443", "https://api.example.com/users?page=2"},
+		{"api.example.com", "8443", "https://api.example.com:8443/users?page=2"},
+	}
+	for _, i := range cases {
+		req := httptest.NewRequest(http.MethodPost, "http://"+i[0]+"/users?page=2", nil)
+		req.Host = i[0]
+		res := httptest.NewRecorder()
+		redirectToHTTPS(i[1]).ServeHTTP(res, req)
+
+		if res.Code != http.StatusPermanentRedirect {
+			t.Errorf("expected 308, got %d", res.Code)
+		}
+		if res.Header().Get("Location") != i[2] {
+			t.Error("'" + res.Header().Get("Location") + "' != '" + i[2] + "'")
+		}
+	}
+}
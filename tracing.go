@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceparentHeader carries W3C trace context, https://www.w3.org/TR/trace-context/
+const traceparentHeader = "traceparent"
+
+// tracestateHeader carries vendor state of the trace, forwarded as the caller sent it
+const tracestateHeader = "tracestate"
+
+// Span kinds, numbered as in OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// spanContext identifies a span within a trace, whether ours or a remote parent's
+type spanContext struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	sampled    bool
+	traceState string
+}
+
+type spanContextKey struct{}
+
+// parseTraceparent reads a traceparent header, ok is false when it's missing or malformed
+func parseTraceparent(header string) (c spanContext, ok bool) {
+	// version-traceid-spanid-flags, later versions may append fields
+	if len(header) < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return c, false
+	}
+
+	version := header[:2]
+	if version == "ff" || (version == "00" && len(header) != 55) || (len(header) > 55 && header[55] != '-') {
+		return c, false
+	}
+
+	var flags [1]byte
+	for _, field := range []struct {
+		hex string
+		out []byte
+	}{{version, make([]byte, 1)}, {header[3:35], c.traceID[:]}, {header[36:52], c.spanID[:]}, {header[53:55], flags[:]}} {
+		if !isLowerHex(field.hex) {
+			return c, false
+		}
+		hex.Decode(field.out, []byte(field.hex))
+	}
+
+	if c.traceID == [16]byte{} || c.spanID == [8]byte{} {
+		return c, false
+	}
+
+	c.sampled = flags[0]&1 == 1
+	return c, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c spanContext) traceparent() string {
+	flags := "00"
+	if c.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.traceID[:]) + "-" + hex.EncodeToString(c.spanID[:]) + "-" + flags
+}
+
+// Span is a timed operation within a trace. Spans are only created while
+// tracing is on, and every method can be called on a nil Span.
+type Span struct {
+	context  spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	tracer   *tracer
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []interface{}
+	err        string
+}
+
+// SetAttributes adds key value pairs to the span
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, kv...)
+}
+
+// SetError marks the span as failed, a nil err leaves it alone
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and hands it to the exporter when sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+
+	if !ended && s.context.sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// SpanExporter receives sampled spans as they end
+type SpanExporter interface {
+	Export(span *Span)
+	// Shutdown sends anything still held, giving up when ctx is done
+	Shutdown(ctx context.Context) error
+}
+
+type tracer struct {
+	exporter SpanExporter
+	// sampleRatio is the share of new traces that are sampled, traces
+	// started upstream of the proxy keep their own decision
+	sampleRatio float64
+}
+
+// tracing is off until init configures an exporter
+var tracing = &tracer{}
+
+func (t *tracer) enabled() bool {
+	return t.exporter != nil
+}
+
+// extractTraceContext returns ctx with the caller's trace context from header, if it sent one
+func extractTraceContext(ctx context.Context, header http.Header) context.Context {
+	if c, ok := parseTraceparent(header.Get(traceparentHeader)); ok {
+		c.traceState = strings.Join(header[http.CanonicalHeaderKey(tracestateHeader)], ",")
+		return context.WithValue(ctx, spanContextKey{}, c)
+	}
+	return ctx
+}
+
+// injectTraceContext sets the traceparent and tracestate headers for the current
+// span in ctx. The caller's tracestate only goes with the trace it belongs to.
+// With tracing off the caller's headers go upstream untouched.
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if !tracing.enabled() {
+		return
+	}
+
+	if c, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		header.Set(traceparentHeader, c.traceparent())
+		if c.traceState != "" {
+			header.Set(tracestateHeader, c.traceState)
+		} else {
+			header.Del(tracestateHeader)
+		}
+	}
+}
+
+// startSpan starts a span as a child of the one in ctx, or a new trace when
+// there is none. The span is nil while tracing is off.
+func startSpan(ctx context.Context, name string, kind int, kv ...interface{}) (context.Context, *Span) {
+	t := tracing
+	if !t.enabled() {
+		return ctx, nil
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now(), tracer: t, attributes: kv}
+
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.context.traceState = parent.traceState
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = randomFraction() < t.sampleRatio
+	}
+	rand.Read(s.context.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s.context), s
+}
+
+func randomFraction() float64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// traceID is the hex trace ID, for correlating logs
+func (s *Span) traceID() string {
+	return hex.EncodeToString(s.context.traceID[:])
+}
+
+// endServerSpan finishes the span of a request once the response in w is done
+func endServerSpan(span *Span, record *accessRecord, w *accessLogResponseWriter) {
+	status := w.statusCode()
+	span.SetAttributes("http.route", record.route, "http.status_code", status)
+
+	if status >= 500 {
+		message := record.err
+		if message == "" {
+			message = http.StatusText(status)
+		}
+		span.SetError(errors.New(message))
+	}
+	span.End()
+}
+
+// memoryExporter keeps spans in memory, for tests
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) Export(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *memoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// ended returns the spans exported so far, in the order they ended
+func (e *memoryExporter) ended() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+// otlpExporter sends spans in batches to an OTLP/HTTP collector, encoded as JSON
+type otlpExporter struct {
+	endpoint string
+	headers  http.Header
+	service  string
+	client   *http.Client
+	batch    int
+	interval time.Duration
+
+	queue chan *Span
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newOTLPExporter starts an exporter posting to endpoint, eg http://collector:4318/v1/traces
+func newOTLPExporter(endpoint string, headers http.Header, service string) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		batch:    512,
+		interval: 5 * time.Second,
+		queue:    make(chan *Span, 4096),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues span, dropping it when the collector can't keep up
+func (e *otlpExporter) Export(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		logger.Debug("dropping span, export queue is full", "span", span.name)
+	}
+}
+
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	e.once.Do(func() { close(e.stop) })
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var spans []*Span
+	flush := func() {
+		if len(spans) > 0 {
+			if err := e.send(spans); err != nil {
+				logger.Warn("unable to export spans", "endpoint", e.endpoint, "spans", len(spans), "error", err)
+			}
+			spans = nil
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			spans = append(spans, span)
+			if len(spans) >= e.batch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.queue:
+					spans = append(spans, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) send(spans []*Span) error {
+	b, err := json.Marshal(otlpRequest(e.service, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", res.Status)
+	}
+	return nil
+}
+
+// parseOTLPHeaders reads headers for the collector written as "key1=value1,key2=value2",
+// where values are URL encoded
+func parseOTLPHeaders(list string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("malformed otlp header: %s", pair)
+		}
+
+		value, err := url.PathUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		headers.Add(strings.TrimSpace(parts[0]), value)
+	}
+	return headers, nil
+}
+
+// otlpRequest is an ExportTraceServiceRequest in the OTLP JSON encoding
+func otlpRequest(service string, spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.context.traceID[:]),
+			"spanId":            hex.EncodeToString(s.context.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.err}
+		}
+		s.mu.Unlock()
+
+		encoded = append(encoded, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]interface{}{"service.name", service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "goproxy"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(kv []interface{}) []interface{} {
+	attributes := []interface{}{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		var value map[string]interface{}
+		switch v := kv[i+1].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		attributes = append(attributes, map[string]interface{}{"key": fmt.Sprint(kv[i]), "value": value})
+	}
+	return attributes
+}
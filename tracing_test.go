@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func testTracing(sampleRatio float64) (*memoryExporter, func()) {
+	previous := tracing
+	exporter := &memoryExporter{}
+	tracing = &tracer{exporter: exporter, sampleRatio: sampleRatio}
+	return exporter, func() { tracing = previous }
+}
+
+func spanNamed(t *testing.T, spans []*Span, name string) *Span {
+	for _, s := range spans {
+		if s.name == name {
+			return s
+		}
+	}
+	t.Fatal("no span named " + name)
+	return nil
+}
+
+func spanID(s *Span) string {
+	return hex.EncodeToString(s.context.spanID[:])
+}
+
+func parentID(s *Span) string {
+	return hex.EncodeToString(s.parentID[:])
+}
+
+func TestTraceparent(t *testing.T) {
+	valid := []string{
+		testTraceparent,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		// Later versions may add fields
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, header := range valid {
+		c, ok := parseTraceparent(header)
+		if !ok {
+			t.Error("expected " + header + " to parse")
+			continue
+		}
+		if result := c.traceparent(); result != "00"+header[2:55] {
+			t.Error("'" + result + "' != '00" + header[2:55] + "'")
+		}
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+	}
+	for _, header := range invalid {
+		if _, ok := parseTraceparent(header); ok {
+			t.Error("expected " + header + " to be rejected")
+		}
+	}
+}
+
+func TestRequestSpans(t *testing.T) {
+	exporter, restore := testTracing(1)
+	defer restore()
+
+	previousClient := authClient
+	authClient = &CognitoAppClient{WellKnownJWKs: &jwk.Set{}}
+	defer func() { authClient = previousClient }()
+
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"firstName":"Ada"}`))
+	req.Header.Set(traceparentHeader, testTraceparent)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	res := httptest.NewRecorder()
+	handleRequest(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", res.Code)
+	}
+
+	spans := exporter.ended()
+	server := spanNamed(t, spans, "HTTP POST")
+	if server.kind != SpanKindServer || parentID(server) != "00f067aa0ba902b7" {
+		t.Error("expected the request span to continue the caller's trace")
+	}
+
+	for _, name := range []string{"validate request body", "convert request keys", "verify jwt"} {
+		s := spanNamed(t, spans, name)
+		if s.traceID() != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID(s) != spanID(server) {
+			t.Errorf("%s: expected a child of the request span", name)
+		}
+	}
+	if spanNamed(t, spans, "verify jwt").err == "" {
+		t.Error("expected the failed verification on its span")
+	}
+
+	var status interface{}
+	for i := 0; i+1 < len(server.attributes); i += 2 {
+		if server.attributes[i] == "http.status_code" {
+			status = server.attributes[i+1]
+		}
+	}
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected the status on the request span, got %v", status)
+	}
+}
+
+func TestUpstreamSpan(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(tracestateHeader, r.Header.Get(tracestateHeader))
+		w.Write([]byte(r.Header.Get(traceparentHeader)))
+	}))
+	defer upstream.Close()
+
+	proxy := func(sampleRatio float64) (string, []*Span) {
+		exporter, restore := testTracing(sampleRatio)
+		defer restore()
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx, span := startSpan(req.Context(), "HTTP GET", SpanKindServer)
+		res := httptest.NewRecorder()
+		serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, res, req.WithContext(ctx))
+		span.End()
+
+		return res.Body.String(), exporter.ended()
+	}
+
+	received, spans := proxy(1)
+	client := spanNamed(t, spans, "upstream GET")
+	if expected := "00-" + client.traceID() + "-" + spanID(client) + "-01"; received != expected {
+		t.Error("'" + received + "' != '" + expected + "'")
+	}
+	if client.kind != SpanKindClient || parentID(client) != spanID(spanNamed(t, spans, "HTTP GET")) {
+		t.Error("expected the upstream span under the request span")
+	}
+
+	// Unsampled traces still propagate, flagged as such
+	received, spans = proxy(0)
+	if len(spans) != 0 || !strings.HasSuffix(received, "-00") {
+		t.Errorf("expected an unsampled traceparent and no spans, got %q and %d spans", received, len(spans))
+	}
+
+	// The caller's tracestate goes with its trace, and only with it
+	for _, i := range []struct {
+		traceparent string
+		tracestate  string
+	}{
+		{testTraceparent, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7"},
+		{"not a traceparent", ""},
+	} {
+		exporter, restore := testTracing(1)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(traceparentHeader, i.traceparent)
+		req.Header.Add(tracestateHeader, "congo=t61rcWkgMzE")
+		req.Header.Add(tracestateHeader, "rojo=00f067aa0ba902b7")
+		ctx, span := startSpan(extractTraceContext(req.Context(), req.Header), "HTTP GET", SpanKindServer)
+		res := httptest.NewRecorder()
+		serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, res, req.WithContext(ctx))
+		span.End()
+		restore()
+
+		if received := res.Header().Get(tracestateHeader); received != i.tracestate {
+			t.Error(i.traceparent + ": '" + received + "' != '" + i.tracestate + "'")
+		}
+		if len(exporter.ended()) != 2 {
+			t.Errorf("expected 2 spans, got %d", len(exporter.ended()))
+		}
+	}
+
+	// With tracing off the caller's header goes through as it came
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(traceparentHeader, testTraceparent)
+	res := httptest.NewRecorder()
+	serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, res, req)
+	if res.Body.String() != testTraceparent {
+		t.Error("'" + res.Body.String() + "' != '" + testTraceparent + "'")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+	}))
+	defer collector.Close()
+
+	headers, err := parseOTLPHeaders("authorization=Bearer%20abc, x-tenant = ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newOTLPExporter(collector.URL+"/v1/traces", headers, "edge-proxy")
+
+	previous := tracing
+	tracing = &tracer{exporter: exporter, sampleRatio: 1}
+	ctx := extractTraceContext(context.Background(), http.Header{"Traceparent": {testTraceparent}})
+	_, span := startSpan(ctx, "upstream GET", SpanKindClient, "http.status_code", 502, "retried", false)
+	span.SetError(errors.New("connection refused"))
+	span.End()
+	tracing = previous
+
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := exporter.Shutdown(shutdown); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-received
+	if req.URL.Path != "/v1/traces" || req.Header.Get("Authorization") != "Bearer abc" || req.Header.Get("X-Tenant") != "ops" {
+		t.Errorf("unexpected export request %s %v", req.URL.Path, req.Header)
+	}
+
+	var export struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]interface{}
+			}
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	body := <-bodies
+	if err := json.Unmarshal(body, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := export.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	cases := [][]string{
+		{"traceId", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"parentSpanId", "00f067aa0ba902b7"},
+		{"name", "upstream GET"},
+	}
+	for _, i := range cases {
+		if value, _ := exported[i[0]].(string); value != i[1] {
+			t.Error("'" + value + "' != '" + i[1] + "'")
+		}
+	}
+	if status, _ := exported["status"].(map[string]interface{}); status["code"] != float64(2) || status["message"] != "connection refused" {
+		t.Errorf("unexpected status %v", exported["status"])
+	}
+	for _, expected := range []string{
+		`{"key":"service.name","value":{"stringValue":"edge-proxy"}}`,
+		`{"key":"http.status_code","value":{"intValue":"502"}}`,
+		`{"key":"retried","value":{"boolValue":false}}`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Error("expected " + expected + " in " + string(body))
+		}
+	}
+
+	if _, err := parseOTLPHeaders("no-equals"); err == nil {
+		t.Error("expected a header without a value to be rejected")
+	}
+}
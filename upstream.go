@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// UpstreamConfig describes a backend that routes proxy requests to
+type UpstreamConfig struct {
+	URL string `json:"url"`
+	// Protocol is "http/1.1" (the default, h2 is still negotiated for https URLs),
+	// "h2" to require HTTP/2 over TLS or "h2c" for HTTP/2 without TLS
+	Protocol string `json:"protocol"`
+	// TLS customises how https upstreams are verified and authenticated
+	TLS *UpstreamTLSConfig `json:"tls"`
+	// HealthPath is requested to check the upstream is healthy, without one a
+	// connection is opened instead
+	HealthPath string `json:"healthPath"`
+
+	target    *url.URL
+	transport http.RoundTripper
+	health    upstreamHealth
+}
+
+// prepare parses the upstream URL and builds the transport shared by every request to it
+func (u *UpstreamConfig) prepare() error {
+	target, err := url.Parse(u.URL)
+	if err != nil {
+		return err
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("upstream url must be http or https: %s", u.URL)
+	}
+
+	var tlsConfig *tls.Config
+	if u.TLS != nil {
+		if target.Scheme != "https" || u.Protocol == "h2c" {
+			return errors.New("upstream tls settings need an https url")
+		}
+
+		tlsConfig, err = u.TLS.clientConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch u.Protocol {
+	case "", "http/1.1":
+		u.transport = http.DefaultTransport
+		if tlsConfig != nil {
+			u.transport, err = tlsTransport(tlsConfig)
+			if err != nil {
+				return err
+			}
+		}
+	case "h2":
+		u.transport = &http2.Transport{TLSClientConfig: tlsConfig}
+	case "h2c":
+		// Cleartext HTTP/2 still goes through the TLS dial hook, which gets a plain connection here
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		u.transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+	default:
+		return fmt.Errorf("unknown upstream protocol: %s", u.Protocol)
+	}
+
+	u.target = target
+	return nil
+}
+
+// UpstreamTLSConfig holds the TLS settings for connections to one upstream
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle of roots trusted instead of the system ones
+	CAFile string `json:"caFile"`
+	// CertFile and KeyFile are a client certificate presented to upstreams that require mTLS
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ServerName is verified against the upstream's certificate instead of the URL's host
+	ServerName string `json:"serverName"`
+	// PinnedFingerprints are hex SHA-256 digests of certificates, one of which must
+	// appear in the upstream's verified chain. Colons between bytes are allowed.
+	PinnedFingerprints []string `json:"pinnedFingerprints"`
+}
+
+func (c *UpstreamTLSConfig) clientConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if len(c.PinnedFingerprints) > 0 {
+		pins := make([][]byte, len(c.PinnedFingerprints))
+		for i, fingerprint := range c.PinnedFingerprints {
+			pin, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("pinned fingerprint is not a hex sha-256 digest: %s", fingerprint)
+			}
+			pins[i] = pin
+		}
+		config.VerifyPeerCertificate = verifyPinnedCertificate(pins)
+	}
+
+	return config, nil
+}
+
+// verifyPinnedCertificate accepts a handshake when any certificate in a
+// verified chain matches one of pins. It runs after the usual verification.
+func verifyPinnedCertificate(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, certificate := range chain {
+				fingerprint := sha256.Sum256(certificate.Raw)
+				for _, pin := range pins {
+					if bytes.Equal(fingerprint[:], pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("upstream certificate doesn't match any pinned fingerprint")
+	}
+}
+
+// tlsTransport is http.DefaultTransport with tlsConfig, still negotiating HTTP/2
+func tlsTransport(tlsConfig *tls.Config) (http.RoundTripper, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func testUpstream(t *testing.T, url string) *UpstreamConfig {
+	upstream := &UpstreamConfig{URL: url}
+	if err := upstream.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return upstream
+}
+
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestLoadProxyConfigUpstreams(t *testing.T) {
+	config, err := loadProxyConfig("", &UpstreamConfig{URL: "http://backend:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.upstream(config.route("/")).target.Host != "backend:8080" {
+		t.Error("expected routes to use the default upstream")
+	}
+
+	cases := []*UpstreamConfig{
+		{URL: "ftp://backend"},
+		{URL: "http://backend", Protocol: "spdy"},
+	}
+	for _, i := range cases {
+		if _, err := loadProxyConfig("", i); err == nil {
+			t.Error("expected " + i.URL + " " + i.Protocol + " to be rejected")
+		}
+	}
+}
+
+func TestGRPCPassThroughH2C(t *testing.T) {
+	frame := []byte{0, 0, 0, 0, 3, 0x08, 0x96, 0x01}
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Error("expected the upstream to be reached over HTTP/2")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if !bytes.Equal(body, frame) {
+			t.Error("request message was modified")
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer upstream.Close()
+
+	target := &UpstreamConfig{URL: upstream.URL, Protocol: "h2c"}
+	if err := target.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(h2c.NewHandler(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveReverseProxy(target, &RouteConfig{}, w, r)
+	})), &http2.Server{}))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/echo.Echo/Say", bytes.NewReader(frame))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := h2cClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !bytes.Equal(body, frame) {
+		t.Error("response message was modified")
+	}
+	if resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Error(resp.Header.Get("Content-Type"))
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Error("expected the grpc-status trailer to reach the client")
+	}
+}
+
+func TestGRPCUnauthenticated(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/echo.Echo/Say", bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	req.Header.Set("Content-Type", "application/grpc")
+	res := httptest.NewRecorder()
+	handleRequest(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", res.Code)
+	}
+	if res.Header().Get("Grpc-Status") != "16" {
+		t.Error("expected UNAUTHENTICATED, got " + res.Header().Get("Grpc-Status"))
+	}
+}
+
+// writePEM writes der as a PEM block of kind to dir/name and returns the path
+func writePEM(dir, name, kind string, der []byte) string {
+	path := filepath.Join(dir, name)
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+	return path
+}
+
+func upstreamStatus(t *testing.T, upstream *UpstreamConfig) int {
+	if err := upstream.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	res := httptest.NewRecorder()
+	serveReverseProxy(upstream, &RouteConfig{}, res, req)
+	return res.Code
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upstream")
+	defer os.RemoveAll(dir)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caFile := writePEM(dir, "upstream.crt", "CERTIFICATE", upstream.Certificate().Raw)
+	fingerprint := sha256.Sum256(upstream.Certificate().Raw)
+	pin := hex.EncodeToString(fingerprint[:])
+	other := sha256.Sum256([]byte("another certificate"))
+
+	cases := []struct {
+		tls    *UpstreamTLSConfig
+		status int
+	}{
+		{nil, http.StatusBadGateway},
+		{&UpstreamTLSConfig{CAFile: caFile}, http.StatusOK},
+		{&UpstreamTLSConfig{CAFile: caFile, ServerName: "example.com"}, http.StatusOK},
+		{&UpstreamTLSConfig{CAFile: caFile, ServerName: "internal.example.org"}, http.StatusBadGateway},
+		{&UpstreamTLSConfig{CAFile: caFile, PinnedFingerprints: []string{pin}}, http.StatusOK},
+		{&UpstreamTLSConfig{CAFile: caFile, PinnedFingerprints: []string{strings.ToUpper(pin[:2]) + ":" + pin[2:]}}, http.StatusOK},
+		{&UpstreamTLSConfig{CAFile: caFile, PinnedFingerprints: []string{hex.EncodeToString(other[:])}}, http.StatusBadGateway},
+	}
+	for _, i := range cases {
+		for _, protocol := range []string{"", "h2"} {
+			status := upstreamStatus(t, &UpstreamConfig{URL: upstream.URL, Protocol: protocol, TLS: i.tls})
+			if status != i.status {
+				t.Errorf("%+v %s: expected %d, got %d", i.tls, protocol, i.status, status)
+			}
+		}
+	}
+}
+
+func TestUpstreamClientCertificate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upstream")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	clients := x509.NewCertPool()
+	clients.AddCert(ca.certificate)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	certificate := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "proxy"}})
+	keyDER, _ := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	tlsConfig := &UpstreamTLSConfig{
+		CAFile:   writePEM(dir, "upstream.crt", "CERTIFICATE", upstream.Certificate().Raw),
+		CertFile: writePEM(dir, "proxy.crt", "CERTIFICATE", certificate.Certificate[0]),
+		KeyFile:  writePEM(dir, "proxy.key", "EC PRIVATE KEY", keyDER),
+	}
+
+	target := &UpstreamConfig{URL: upstream.URL, TLS: tlsConfig}
+	if err := target.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	res := httptest.NewRecorder()
+	serveReverseProxy(target, &RouteConfig{}, res, req)
+	if res.Code != http.StatusOK || res.Body.String() != "proxy" {
+		t.Errorf("expected the upstream to see the proxy's certificate, got %d %q", res.Code, res.Body.String())
+	}
+
+	withoutCertificate := &UpstreamTLSConfig{CAFile: tlsConfig.CAFile}
+	if status := upstreamStatus(t, &UpstreamConfig{URL: upstream.URL, TLS: withoutCertificate}); status != http.StatusBadGateway {
+		t.Errorf("expected 502 without a client certificate, got %d", status)
+	}
+}
+
+func TestUpstreamTLSValidation(t *testing.T) {
+	cases := []*UpstreamConfig{
+		{URL: "http://backend", TLS: &UpstreamTLSConfig{}},
+		{URL: "https://backend", Protocol: "h2c", TLS: &UpstreamTLSConfig{}},
+		{URL: "https://backend", TLS: &UpstreamTLSConfig{CAFile: "missing.crt"}},
+		{URL: "https://backend", TLS: &UpstreamTLSConfig{CertFile: "missing.crt", KeyFile: "missing.key"}},
+		{URL: "https://backend", TLS: &UpstreamTLSConfig{PinnedFingerprints: []string{"abcd"}}},
+	}
+	for _, i := range cases {
+		if err := i.prepare(); err == nil {
+			t.Errorf("expected %+v to be rejected", i.TLS)
+		}
+	}
+}
@@ -13,6 +13,32 @@ type User struct {
 	attributes    UserAttributes
 }
 
+// expiresAt returns the expiry time of the user's token
+func (u User) expiresAt() (time.Time, bool) {
+	claims, ok := u.claims.(jwt.MapClaims)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(exp), 0), true
+}
+
+// subject returns the sub claim of the user's token
+func (u User) subject() string {
+	claims, ok := u.claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
 // UserAttributes for User struct
 type UserAttributes struct {
 	Enabled          bool                 `json:"enabled"`
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// userCache is a bounded LRU of the attributes AdminGetUser returned, kept for
+// ttl so a user's repeat requests skip the Cognito call. Changes to a user, such
+// as disabling them, take up to ttl to apply unless the entry is removed.
+type userCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type userCacheEntry struct {
+	username   string
+	attributes UserAttributes
+	expires    time.Time
+}
+
+// userAttributes caches lookups for authenticate, off until init configures it
+var userAttributes = newUserCache(0, 0)
+
+// newUserCache returns a cache holding at most size users for ttl, a ttl or size of 0 disables caching
+func newUserCache(ttl time.Duration, size int) *userCache {
+	return &userCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *userCache) enabled() bool {
+	return c.ttl > 0 && c.size > 0
+}
+
+func (c *userCache) get(username string) (UserAttributes, bool) {
+	if !c.enabled() {
+		return UserAttributes{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[username]
+	if !ok {
+		return UserAttributes{}, false
+	}
+
+	entry := element.Value.(*userCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, username)
+		return UserAttributes{}, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.attributes, true
+}
+
+func (c *userCache) add(username string, attributes UserAttributes) {
+	if !c.enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &userCacheEntry{username: username, attributes: attributes, expires: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[username]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[username] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*userCacheEntry).username)
+	}
+}
+
+// remove drops username, reporting whether it was cached
+func (c *userCache) remove(username string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[username]
+	if ok {
+		c.order.Remove(element)
+		delete(c.entries, username)
+	}
+	return ok
+}
+
+// flush empties the cache, returning how many users it held
+func (c *userCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.order.Len()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	return n
+}
+
+// expiries returns when each cached user expires, by username
+func (c *userCache) expiries() map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiries := make(map[string]time.Time, len(c.entries))
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*userCacheEntry)
+		expiries[entry.username] = entry.expires
+	}
+	return expiries
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserCache(t *testing.T) {
+	cache := newUserCache(time.Minute, 2)
+	cache.add("ada", UserAttributes{Username: "ada", Status: "CONFIRMED"})
+	cache.add("grace", UserAttributes{Username: "grace"})
+
+	if attributes, ok := cache.get("ada"); !ok || attributes.Status != "CONFIRMED" {
+		t.Error("expected ada to be cached")
+	}
+
+	// ada was used last, so grace makes room for alan
+	cache.add("alan", UserAttributes{Username: "alan"})
+	if _, ok := cache.get("grace"); ok {
+		t.Error("expected the least recently used user to be evicted")
+	}
+	if len(cache.expiries()) != 2 {
+		t.Errorf("expected 2 users, got %d", len(cache.expiries()))
+	}
+
+	if !cache.remove("ada") || cache.remove("ada") {
+		t.Error("expected ada to be removed once")
+	}
+	if flushed := cache.flush(); flushed != 1 {
+		t.Errorf("expected 1 user flushed, got %d", flushed)
+	}
+
+	short := newUserCache(10*time.Millisecond, 10)
+	short.add("ada", UserAttributes{Username: "ada"})
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := short.get("ada"); ok {
+		t.Error("expected the entry to expire")
+	}
+
+	off := newUserCache(0, 10)
+	off.add("ada", UserAttributes{Username: "ada"})
+	if _, ok := off.get("ada"); ok || off.enabled() {
+		t.Error("expected a ttl of 0 to disable the cache")
+	}
+}
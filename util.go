@@ -12,3 +12,11 @@ func getEnv(key string) string {
 
 	panic(fmt.Sprintf("Unable to read environment key: %s", key))
 }
+
+func getEnvDefault(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return fallback
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
 // IsJSON check for request body
@@ -15,25 +17,56 @@ func IsJSON(content []byte) bool {
 	return json.Unmarshal(content, &js) == nil
 }
 
-func validJSONRequestBody(req *http.Request) (bool, error) {
+// isJSONContent reports whether a Content-Type declares JSON, including `+json` types like application/problem+json
+func isJSONContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
+
+func validJSONRequestBody(req *http.Request, route *RouteConfig) (bool, error) {
+	// gRPC messages are protobuf frames, they go upstream untouched
+	if isGRPCRequest(req) {
+		return true, nil
+	}
+
 	if req.Method == "POST" || req.Method == "PUT" {
-		body, err := ioutil.ReadAll(req.Body)
+		body, stream, err := bufferBody(req.Body, req.ContentLength)
 
 		if err != nil {
-			log.Println(err)
-			log.Println("unable to read request body for JSON validation")
+			logger.Error("unable to read request body for JSON validation", "error", err)
 			return false, err
 		}
 
+		if stream != nil {
+			// Too large to hold in memory, it goes upstream without validation or conversion
+			req.Body = stream
+			return true, nil
+		}
+
 		// Close the body since we read it, and in case it's not valid JSON
 		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 
+		if route.ConvertForm && isFormContent(req.Header.Get("Content-Type")) {
+			return validFormRequestBody(req, body)
+		}
+
 		if !IsJSON(body) {
-			log.Println("invalid JSON in request body")
+			logger.Info("invalid JSON in request body")
 			return false, nil
 		}
 
-		body = convertKeys(json.RawMessage(body), "camel")
+		_, conversion := startSpan(req.Context(), "convert request keys", SpanKindInternal, "content.type", "json")
+		body, err = convertKeys(json.RawMessage(body), "camel", conversionPolicy)
+		conversion.SetError(err)
+		conversion.End()
+		if err != nil {
+			logger.Warn("unable to convert keys in request body", "error", err)
+			return false, err
+		}
 
 		// Set content type header since we validated that it is JSON, calculate lengths
 		req.Header.Set("Content-Type", "application/json")
@@ -45,5 +78,29 @@ func validJSONRequestBody(req *http.Request) (bool, error) {
 		return true, nil
 	}
 
-	return false, nil
+	// Nothing to validate for methods without a body
+	return true, nil
+}
+
+func validFormRequestBody(req *http.Request, body []byte) (bool, error) {
+	if _, err := url.ParseQuery(string(body)); err != nil {
+		logger.Info("invalid form in request body", "error", err)
+		return false, nil
+	}
+
+	_, conversion := startSpan(req.Context(), "convert request keys", SpanKindInternal, "content.type", "form")
+	form, err := convertQuery(string(body), "camel", conversionPolicy)
+	conversion.SetError(err)
+	conversion.End()
+	if err != nil {
+		logger.Warn("unable to convert field names in request body", "error", err)
+		return false, err
+	}
+
+	req.Header.Set("Content-Length", strconv.Itoa(len(form)))
+	req.ContentLength = int64(len(form))
+
+	req.Body = ioutil.NopCloser(strings.NewReader(form))
+
+	return true, nil
 }
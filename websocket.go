@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Browsers can't set an Authorization header on a WebSocket handshake, so the
+// token may also be sent as a `bearer.<token>` Sec-WebSocket-Protocol entry
+// next to the real subprotocol, or as an access_token query parameter
+const webSocketProtocolPrefix = "bearer."
+const webSocketTokenParam = "access_token"
+
+func isUpgradeRequest(req *http.Request) bool {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	return isUpgradeRequest(req) && strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// takeWebSocketToken moves a token sent as a subprotocol entry or query parameter
+// into the Authorization header, so it is authenticated like any other request
+// and never forwarded upstream or logged. When the token entry was the only
+// subprotocol offered, it's returned for the handshake response to echo.
+func takeWebSocketToken(req *http.Request) string {
+	var token, tokenProtocol string
+
+	var protocols []string
+	for _, value := range req.Header["Sec-Websocket-Protocol"] {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if strings.HasPrefix(protocol, webSocketProtocolPrefix) {
+				token = strings.TrimPrefix(protocol, webSocketProtocolPrefix)
+				tokenProtocol = protocol
+				continue
+			}
+			protocols = append(protocols, protocol)
+		}
+	}
+
+	if len(protocols) > 0 {
+		req.Header.Set("Sec-Websocket-Protocol", strings.Join(protocols, ", "))
+		tokenProtocol = ""
+	} else {
+		req.Header.Del("Sec-Websocket-Protocol")
+	}
+
+	if param, rest, ok := removeQueryParam(req.URL.RawQuery, webSocketTokenParam); ok {
+		if token == "" {
+			token = param
+		}
+		req.URL.RawQuery = rest
+	}
+
+	if token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return tokenProtocol
+}
+
+// removeQueryParam takes every name pair out of a raw query string, leaving the
+// rest as it was sent. It returns the first value of name and whether there was one.
+func removeQueryParam(rawQuery, name string) (string, string, bool) {
+	var value string
+	var found bool
+	kept := make([]string, 0, strings.Count(rawQuery, "&")+1)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, v := pair, ""
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			key, v = pair[:i], pair[i+1:]
+		}
+		if unescaped, err := url.QueryUnescape(key); err != nil || unescaped != name {
+			kept = append(kept, pair)
+			continue
+		}
+
+		if !found {
+			value, _ = url.QueryUnescape(v)
+			found = true
+		}
+	}
+	return value, strings.Join(kept, "&"), found
+}
+
+type webSocketProtocolContextKey struct{}
+
+// withWebSocketProtocol returns ctx carrying the subprotocol the handshake response has to echo
+func withWebSocketProtocol(ctx context.Context, protocol string) context.Context {
+	return context.WithValue(ctx, webSocketProtocolContextKey{}, protocol)
+}
+
+// echoWebSocketProtocol selects the token entry in a handshake response when it
+// was the only subprotocol offered. The upstream never saw it so selects none,
+// and browsers abort handshakes that don't select one of the protocols offered.
+func echoWebSocketProtocol(resp *http.Response) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Request == nil || resp.Header.Get("Sec-Websocket-Protocol") != "" {
+		return nil
+	}
+
+	if protocol, ok := resp.Request.Context().Value(webSocketProtocolContextKey{}).(string); ok {
+		resp.Header.Set("Sec-Websocket-Protocol", protocol)
+	}
+	return nil
+}
+
+// expiringResponseWriter closes a hijacked connection, such as a proxied
+// WebSocket, when the token that opened it expires
+type expiringResponseWriter struct {
+	http.ResponseWriter
+	expires time.Time
+}
+
+func (w *expiringResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timer := time.AfterFunc(time.Until(w.expires), func() {
+		logger.Info("closing connection, token expired", "address", conn.RemoteAddr())
+		conn.Close()
+	})
+
+	return &expiringConn{Conn: conn, timer: timer}, rw, nil
+}
+
+type expiringConn struct {
+	net.Conn
+	timer *time.Timer
+}
+
+func (c *expiringConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
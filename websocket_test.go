@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestTakeWebSocketToken(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/socket?room=1", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", "chat.v1, bearer.abc.def.ghi")
+	takeWebSocketToken(req)
+
+	if req.Header.Get("Authorization") != "Bearer abc.def.ghi" {
+		t.Error(req.Header.Get("Authorization"))
+	}
+	if req.Header.Get("Sec-WebSocket-Protocol") != "chat.v1" {
+		t.Error(req.Header.Get("Sec-WebSocket-Protocol"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/socket?room=1&access_token=xyz", nil)
+	takeWebSocketToken(req)
+
+	if req.Header.Get("Authorization") != "Bearer xyz" {
+		t.Error(req.Header.Get("Authorization"))
+	}
+	if req.URL.RawQuery != "room=1" {
+		t.Error(req.URL.RawQuery)
+	}
+
+	// The rest of the query reaches the upstream as it was sent
+	req = httptest.NewRequest(http.MethodGet, "/socket?sig=a%2Fb&z=1&access_token=xyz&a=2&z=0", nil)
+	takeWebSocketToken(req)
+
+	if req.Header.Get("Authorization") != "Bearer xyz" {
+		t.Error(req.Header.Get("Authorization"))
+	}
+	if req.URL.RawQuery != "sig=a%2Fb&z=1&a=2&z=0" {
+		t.Error(req.URL.RawQuery)
+	}
+
+	// A header token wins, but the other copies are still removed
+	req = httptest.NewRequest(http.MethodGet, "/socket?access_token=xyz", nil)
+	req.Header.Set("Authorization", "Bearer header")
+	req.Header.Set("Sec-WebSocket-Protocol", "bearer.protocol")
+	takeWebSocketToken(req)
+
+	if req.Header.Get("Authorization") != "Bearer header" {
+		t.Error(req.Header.Get("Authorization"))
+	}
+	if req.Header.Get("Sec-WebSocket-Protocol") != "" || req.URL.RawQuery != "" {
+		t.Error("token was left in the request")
+	}
+}
+
+func TestWebSocketTokenNotLogged(t *testing.T) {
+	previous, previousAccess, previousClient := logger, accessLog, authClient
+	l, out := testLogger(t, FormatJSON, LevelInfo)
+	var accessOut bytes.Buffer
+	logger, accessLog = l, &accessLogger{format: AccessLogCommon, sink: writerSink{&accessOut}}
+	authClient = &CognitoAppClient{WellKnownJWKs: &jwk.Set{}}
+	defer func() { logger, accessLog, authClient = previous, previousAccess, previousClient }()
+
+	req := httptest.NewRequest(http.MethodGet, "/ws?room=1&access_token=secret.jwt.token", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	handleRequest(httptest.NewRecorder(), req)
+
+	if !strings.Contains(out.String(), "/ws?room=1") {
+		t.Error("expected the request log to show the request without its token: " + out.String())
+	}
+	if !strings.Contains(accessOut.String(), `"GET /ws?room=1 HTTP/1.1"`) {
+		t.Error("expected the access log to show the request without its token: " + accessOut.String())
+	}
+	if strings.Contains(out.String()+accessOut.String(), "secret.jwt.token") {
+		t.Error("token was logged")
+	}
+}
+
+// echoUpgradeServer accepts any upgrade and echoes bytes back until the connection closes
+func echoUpgradeServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "websocket")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+}
+
+func dialUpgrade(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nAccept-Encoding: gzip\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	return conn, reader
+}
+
+func TestWebSocketProxying(t *testing.T) {
+	upstream := echoUpgradeServer()
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = &expiringResponseWriter{ResponseWriter: w, expires: time.Now().Add(time.Hour)}
+		serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, w, r)
+	})))
+	defer proxy.Close()
+
+	conn, reader := dialUpgrade(t, proxy)
+	defer conn.Close()
+
+	for _, message := range []string{"ping\n", "pong\n"} {
+		io.WriteString(conn, message)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echoed, err := reader.ReadString('\n')
+		if err != nil || echoed != message {
+			t.Errorf("'%s' != '%s' (%v)", echoed, message, err)
+		}
+	}
+}
+
+func TestWebSocketTokenProtocolEchoed(t *testing.T) {
+	upstream := echoUpgradeServer()
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if protocol := takeWebSocketToken(r); protocol != "" {
+			r = r.WithContext(withWebSocketProtocol(r.Context(), protocol))
+		}
+		serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, w, r)
+	}))
+	defer proxy.Close()
+
+	cases := []struct {
+		offered  string
+		selected string
+	}{
+		// The token entry is all the browser offered, so it has to come back
+		{"bearer.abc.def.ghi", "bearer.abc.def.ghi"},
+		// The upstream chooses among the real subprotocols
+		{"chat.v1, bearer.abc.def.ghi", ""},
+	}
+	for _, i := range cases {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: "+i.offered+"\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Protocol") != i.selected {
+			t.Errorf("%s: expected 101 selecting '%s', got %d '%s'", i.offered, i.selected, resp.StatusCode, resp.Header.Get("Sec-WebSocket-Protocol"))
+		}
+	}
+}
+
+func TestWebSocketClosedWhenTokenExpires(t *testing.T) {
+	upstream := echoUpgradeServer()
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = &expiringResponseWriter{ResponseWriter: w, expires: time.Now().Add(200 * time.Millisecond)}
+		serveReverseProxy(testUpstream(t, upstream.URL), &RouteConfig{}, w, r)
+	})))
+	defer proxy.Close()
+
+	conn, reader := dialUpgrade(t, proxy)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}